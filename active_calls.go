@@ -0,0 +1,344 @@
+package omgrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bsm/openmetrics"
+)
+
+// Watchdog alerts (see WatchdogConfig).
+const (
+	WatchdogAlertStuck  = "stuck"  // call is running for longer than its age threshold
+	WatchdogAlertLeaked = "leaked" // call deadline is long gone, but call end was never reported
+)
+
+// ActiveCall holds a point-in-time copy of an in-flight RPC call stats.
+type ActiveCall struct {
+	Method    string        `json:"method"` // full method name
+	Side      string        `json:"side"`   // "client" or "server"
+	Peer      string        `json:"peer"`   // remote address, empty until client call sends its first message
+	BeginTime time.Time     `json:"begin_time"`
+	Deadline  time.Time     `json:"deadline"` // zero if call has no deadline
+	Age       time.Duration `json:"age"`      // time since call began, when snapshot was taken
+	BytesRecv int64         `json:"bytes_recv"`
+	BytesSent int64         `json:"bytes_sent"`
+	Leaked    bool          `json:"leaked"` // set, when watchdog reported the call as leaked
+
+	call *CallStats // immutable copy of call stats, taken when call began
+}
+
+// ActiveCalls keeps track of in-flight RPC calls for debugging.
+// It is fed by its StatsHandler and is safe for concurrent use:
+//
+//	calls := omgrpc.NewActiveCalls()
+//	srv := grpc.NewServer(grpc.StatsHandler(omgrpc.Instrument(
+//	  calls.StatsHandler(),
+//	  omgrpc.InstrumentCallCount(callCount),
+//	)))
+//	http.Handle("/debug/grpc/calls", calls)
+//	defer calls.StartWatchdog(omgrpc.WatchdogConfig{
+//	  MaxAge:  time.Minute,
+//	  Handler: omgrpc.InstrumentWatchdogAlerts(watchdogAlerts),
+//	})()
+//
+// ActiveCalls implements http.Handler, which renders in-flight calls as JSON
+// or as a plain-text table, when requested with "?format=text".
+//
+// Calls are kept till their end arrives; leaked calls, whose end may never arrive, are capped
+// by watchdog (see WatchdogConfig.MaxLeaked).
+type ActiveCalls struct {
+	calls map[*CallStats]*activeCall
+	mu    sync.RWMutex
+}
+
+// activeCall is an ActiveCalls entry.
+type activeCall struct {
+	call CallStats // copy, taken when call began
+
+	peer                 atomic.Value // string, resolved with the first message on client side
+	bytesRecv, bytesSent int64
+	stuck, leaked        int32 // set, when watchdog alert is reported
+}
+
+// NewActiveCalls returns a new ActiveCalls.
+func NewActiveCalls() *ActiveCalls {
+	return &ActiveCalls{calls: make(map[*CallStats]*activeCall)}
+}
+
+// StatsHandler returns a stats.Handler, that registers calls when they begin
+// and unregisters them when they end.
+func (r *ActiveCalls) StatsHandler() *MultiHandler {
+	return Instrument(
+		CallBeginHandler(r.handleBegin),
+		MessageStatsHandler(r.handleMessage),
+		CallStatsHandler(r.handleEnd),
+	)
+}
+
+func (r *ActiveCalls) handleBegin(call *CallStats) {
+	entry := &activeCall{call: *call}
+	entry.call.Timeline = nil // not immutable
+	entry.call.details = nil
+	if entry.call.RemoteAddr != nil { // server
+		entry.peer.Store(entry.call.RemoteAddr.String())
+	}
+
+	r.mu.Lock()
+	r.calls[call] = entry
+	r.mu.Unlock()
+}
+
+func (r *ActiveCalls) handleMessage(call *CallStats, msg *MessageStats) {
+	r.mu.RLock()
+	entry := r.calls[call]
+	r.mu.RUnlock()
+	if entry == nil {
+		return
+	}
+
+	if msg.IsRecv {
+		atomic.AddInt64(&entry.bytesRecv, int64(msg.WireLength))
+	} else {
+		atomic.AddInt64(&entry.bytesSent, int64(msg.WireLength))
+	}
+	if entry.peer.Load() == nil && call.RemoteAddr != nil { // client
+		entry.peer.Store(call.RemoteAddr.String())
+	}
+}
+
+func (r *ActiveCalls) handleEnd(call *CallStats) {
+	r.mu.Lock()
+	delete(r.calls, call)
+	r.mu.Unlock()
+}
+
+// Len returns the number of in-flight calls.
+func (r *ActiveCalls) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.calls)
+}
+
+// Snapshot returns copies of in-flight call stats, oldest first.
+func (r *ActiveCalls) Snapshot() []ActiveCall {
+	now := time.Now()
+
+	r.mu.RLock()
+	calls := make([]ActiveCall, 0, len(r.calls))
+	for _, entry := range r.calls {
+		calls = append(calls, entry.snapshot(now))
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(calls, func(i, j int) bool { return calls[i].BeginTime.Before(calls[j].BeginTime) })
+	return calls
+}
+
+// ServeHTTP renders in-flight calls as JSON (default) or as a plain-text table ("?format=text").
+func (r *ActiveCalls) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	calls := r.Snapshot()
+
+	if req.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeCallTable(w, calls, time.Now())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(calls)
+}
+
+// ----------------------------------------------------------------------------
+
+// WatchdogConfig configures ActiveCalls watchdog.
+type WatchdogConfig struct {
+	// Interval between checks, defaults to 1s.
+	Interval time.Duration
+	// MaxAge is an age threshold for "stuck" alerts, 0 disables them.
+	MaxAge time.Duration
+	// MethodMaxAge overrides MaxAge by full method name, 0 disables "stuck" alerts for the method.
+	MethodMaxAge map[string]time.Duration
+	// LeakGrace is a time after call deadline, when call is considered "leaked", defaults to 10s.
+	// Server call end is reported only when handler returns, so handlers, that ignore context cancellation,
+	// keep calls active past the deadline.
+	// Leaked calls are kept (and marked as such) till their end arrives.
+	//
+	// Calls without deadline are never considered leaked, so they are detected only as "stuck"
+	// and are kept till their end arrives.
+	LeakGrace time.Duration
+	// MaxLeaked is the maximum number of leaked calls to keep, defaults to 1000.
+	// When exceeded, the oldest leaked calls are evicted, so that calls, whose end never arrives, don't accumulate.
+	MaxLeaked int
+	// Handler is invoked once per call for every alert (see WatchdogAlert* constants).
+	Handler func(alert string, call ActiveCall)
+}
+
+func (c *WatchdogConfig) norm() {
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+	if c.LeakGrace <= 0 {
+		c.LeakGrace = 10 * time.Second
+	}
+	if c.MaxLeaked <= 0 {
+		c.MaxLeaked = 1000
+	}
+}
+
+func (c *WatchdogConfig) maxAge(method string) time.Duration {
+	if maxAge, ok := c.MethodMaxAge[method]; ok {
+		return maxAge
+	}
+	return c.MaxAge
+}
+
+// StartWatchdog starts a background watchdog, that checks in-flight calls periodically,
+// reports stuck and leaked ones to cfg.Handler and evicts the oldest leaked ones over cfg.MaxLeaked.
+// It returns a function, that stops the watchdog.
+func (r *ActiveCalls) StartWatchdog(cfg WatchdogConfig) (stop func()) {
+	cfg.norm()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				r.check(&cfg, now)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// check reports stuck and leaked calls and evicts the oldest leaked ones over the limit;
+// handler is invoked without holding the lock.
+func (r *ActiveCalls) check(cfg *WatchdogConfig, now time.Time) {
+	type alert struct {
+		name  string
+		entry *activeCall
+	}
+	type leakedCall struct {
+		key   *CallStats
+		entry *activeCall
+	}
+
+	var alerts []alert
+	var leaked []leakedCall
+	r.mu.RLock()
+	for key, entry := range r.calls {
+		call := &entry.call
+		if maxAge := cfg.maxAge(call.FullMethodName); maxAge > 0 && now.Sub(call.BeginTime) > maxAge &&
+			atomic.CompareAndSwapInt32(&entry.stuck, 0, 1) {
+			alerts = append(alerts, alert{name: WatchdogAlertStuck, entry: entry})
+		}
+		if !call.Deadline.IsZero() && now.Sub(call.Deadline) > cfg.LeakGrace &&
+			atomic.CompareAndSwapInt32(&entry.leaked, 0, 1) {
+			alerts = append(alerts, alert{name: WatchdogAlertLeaked, entry: entry})
+		}
+		if atomic.LoadInt32(&entry.leaked) != 0 {
+			leaked = append(leaked, leakedCall{key: key, entry: entry})
+		}
+	}
+	r.mu.RUnlock()
+
+	if n := len(leaked) - cfg.MaxLeaked; n > 0 {
+		sort.Slice(leaked, func(i, j int) bool { return leaked[i].entry.call.BeginTime.Before(leaked[j].entry.call.BeginTime) })
+
+		r.mu.Lock()
+		for _, c := range leaked[:n] {
+			// call may end and its (pooled) stats may be reused by a new call in the meantime:
+			if r.calls[c.key] == c.entry {
+				delete(r.calls, c.key)
+			}
+		}
+		r.mu.Unlock()
+	}
+
+	if cfg.Handler == nil {
+		return
+	}
+	for _, a := range alerts {
+		cfg.Handler(a.name, a.entry.snapshot(now))
+	}
+}
+
+// InstrumentWatchdogAlerts returns ActiveCalls watchdog handler to count watchdog alerts.
+// Metric family must have "alert" label ("stuck" or "leaked"), it panics otherwise.
+// It populates call labels it can recognize (see package docs) and leaves others empty,
+// labels which are not known until call ends (like "status") are always empty.
+func InstrumentWatchdogAlerts(m openmetrics.CounterFamily, opts ...Option) func(alert string, call ActiveCall) {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newInFlightCallLabeler(desc, o)
+	series := newCounterSeries(m, o)
+	alertIndex := mustLabelIndex(desc, "alert")
+
+	return func(alert string, call ActiveCall) {
+		if call.call == nil {
+			return
+		}
+		if f := o.filter; f != nil && (!f.MatchMethod(call.Method) || !f.MatchSide(call.call.IsClient)) {
+			return
+		}
+		values := labeler.Values(call.call)
+		values.Set(alertIndex, alert)
+		series.Get(values).Add(1)
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+func (e *activeCall) snapshot(now time.Time) ActiveCall {
+	call := ActiveCall{
+		Method:    e.call.FullMethodName,
+		Side:      sideName(e.call.IsClient),
+		BeginTime: e.call.BeginTime,
+		Deadline:  e.call.Deadline,
+		Age:       now.Sub(e.call.BeginTime),
+		BytesRecv: atomic.LoadInt64(&e.bytesRecv),
+		BytesSent: atomic.LoadInt64(&e.bytesSent),
+		Leaked:    atomic.LoadInt32(&e.leaked) != 0,
+		call:      &e.call,
+	}
+	if peer, ok := e.peer.Load().(string); ok {
+		call.Peer = peer
+	}
+	return call
+}
+
+func writeCallTable(w http.ResponseWriter, calls []ActiveCall, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tSIDE\tPEER\tAGE\tDEADLINE\tRECV\tSENT\tLEAKED")
+	for _, call := range calls {
+		deadline := "-"
+		if !call.Deadline.IsZero() {
+			deadline = call.Deadline.Sub(now).Truncate(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%t\n",
+			call.Method,
+			call.Side,
+			call.Peer,
+			call.Age.Truncate(time.Millisecond),
+			deadline,
+			call.BytesRecv,
+			call.BytesSent,
+			call.Leaked,
+		)
+	}
+	_ = tw.Flush()
+}
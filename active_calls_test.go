@@ -0,0 +1,224 @@
+package omgrpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"time"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("ActiveCalls", func() {
+	var (
+		ctx = context.Background()
+
+		subject     *ActiveCalls
+		client      testpb.TestClient
+		clientClose func()
+		teardown    func()
+	)
+
+	openStream := func(ctx context.Context) testpb.Test_StreamClient {
+		stream, err := client.Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.Send(&testpb.Message{Payload: "1"})).To(Succeed())
+		_, err = stream.Recv()
+		Expect(err).NotTo(HaveOccurred())
+		return stream
+	}
+
+	setup := func(serverImpl *testpb.TestServerImpl) {
+		subject = NewActiveCalls()
+		client, clientClose, teardown = initClientServerSystemWith(
+			serverImpl,
+			[]grpc.DialOption{grpc.WithStatsHandler(subject.StatsHandler())},
+			[]grpc.ServerOption{grpc.StatsHandler(subject.StatsHandler())},
+		)
+	}
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("tracks calls in flight", func() {
+		setup(new(testpb.TestServerImpl))
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+
+		stream := openStream(timeoutCtx)
+		Eventually(subject.Len).Should(Equal(2))
+
+		calls := subject.Snapshot()
+		Expect(calls).To(HaveLen(2))
+		Expect(calls[0].BeginTime).To(BeTemporally("<=", calls[1].BeginTime))
+		for _, call := range calls {
+			Expect(call.Method).To(Equal(streamMethod))
+			Expect(call.Peer).To(Equal("bufconn"))
+			Expect(call.Deadline).To(BeTemporally("~", time.Now().Add(time.Minute), time.Second))
+			Expect(call.Age).To(BeNumerically(">", 0))
+			if call.Side == "client" {
+				Expect(call.BytesSent).To(Equal(int64(8)))
+				Expect(call.BytesRecv).To(Equal(int64(16)))
+			} else {
+				Expect(call.BytesRecv).To(Equal(int64(8)))
+				Expect(call.BytesSent).To(Equal(int64(16)))
+			}
+		}
+		Expect([]string{calls[0].Side, calls[1].Side}).To(ConsistOf("client", "server"))
+
+		Expect(stream.CloseSend()).To(Succeed())
+		_, err := stream.Recv()
+		Expect(err).To(HaveOccurred()) // io.EOF
+		Eventually(subject.Len).Should(Equal(0))
+	})
+
+	It("serves JSON and plain-text", func() {
+		setup(new(testpb.TestServerImpl))
+
+		stream := openStream(ctx)
+		Eventually(subject.Len).Should(Equal(2))
+
+		w := httptest.NewRecorder()
+		subject.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var calls []ActiveCall
+		Expect(json.Unmarshal(w.Body.Bytes(), &calls)).To(Succeed())
+		Expect(calls).To(HaveLen(2))
+		Expect(calls[0].Method).To(Equal(streamMethod))
+
+		w = httptest.NewRecorder()
+		subject.ServeHTTP(w, httptest.NewRequest("GET", "/?format=text", nil))
+		Expect(w.Header().Get("Content-Type")).To(HavePrefix("text/plain"))
+		Expect(w.Body.String()).To(MatchRegexp(`^METHOD +SIDE +PEER +AGE +DEADLINE +RECV +SENT +LEAKED\n`))
+		Expect(w.Body.String()).To(ContainSubstring(streamMethod + "  client"))
+		Expect(w.Body.String()).To(ContainSubstring(streamMethod + "  server"))
+
+		Expect(stream.CloseSend()).To(Succeed())
+		clientClose()
+	})
+
+	Describe("watchdog", func() {
+		var (
+			alerts       openmetrics.CounterFamily
+			stopWatchdog func()
+		)
+
+		startWatchdog := func(cfg WatchdogConfig) {
+			alerts = openmetrics.NewConsistentRegistry(mockTime).Counter(openmetrics.Desc{
+				Name:   "grpc_watchdog_alerts",
+				Labels: []string{"method", "side", "alert"},
+			})
+			cfg.Interval = 20 * time.Millisecond
+			cfg.Handler = InstrumentWatchdogAlerts(alerts)
+			stopWatchdog = subject.StartWatchdog(cfg)
+		}
+
+		AfterEach(func() {
+			stopWatchdog()
+		})
+
+		It("reports stuck calls", func() {
+			setup(new(testpb.TestServerImpl))
+			startWatchdog(WatchdogConfig{
+				MaxAge:       100 * time.Millisecond,
+				MethodMaxAge: map[string]time.Duration{unaryMethod: 0},
+			})
+
+			stream := openStream(ctx)
+			Eventually(func() float64 {
+				return alerts.With(streamMethod, "client", "stuck").Total()
+			}).Should(Equal(1.0))
+			Eventually(func() float64 {
+				return alerts.With(streamMethod, "server", "stuck").Total()
+			}).Should(Equal(1.0))
+			Consistently(func() float64 {
+				return alerts.With(streamMethod, "client", "stuck").Total()
+			}, 100*time.Millisecond).Should(Equal(1.0))
+			Expect(alerts.With(streamMethod, "client", "leaked").Total()).To(Equal(0.0))
+
+			Expect(stream.CloseSend()).To(Succeed())
+			clientClose()
+		})
+
+		It("reports leaked calls", func() {
+			setup(&testpb.TestServerImpl{UnaryDelay: 500 * time.Millisecond})
+			startWatchdog(WatchdogConfig{
+				LeakGrace: 100 * time.Millisecond,
+			})
+
+			timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			_, err := client.Unary(timeoutCtx, &testpb.Message{Payload: "1"})
+			Expect(status.Code(err)).To(Equal(codes.DeadlineExceeded))
+
+			// server handler ignores the deadline:
+			Eventually(func() float64 {
+				return alerts.With(unaryMethod, "server", "leaked").Total()
+			}).Should(Equal(1.0))
+			Expect(alerts.With(unaryMethod, "client", "leaked").Total()).To(Equal(0.0))
+			Consistently(func() float64 {
+				return alerts.With(unaryMethod, "server", "leaked").Total()
+			}, 100*time.Millisecond).Should(Equal(1.0))
+
+			// kept, while server handler is still running:
+			calls := subject.Snapshot()
+			Expect(calls).To(HaveLen(1))
+			Expect(calls[0].Side).To(Equal("server"))
+			Expect(calls[0].Leaked).To(BeTrue())
+			Eventually(subject.Len).Should(Equal(0))
+		})
+
+		It("caps leaked calls", func() {
+			setup(&testpb.TestServerImpl{UnaryDelay: 500 * time.Millisecond})
+			startWatchdog(WatchdogConfig{
+				LeakGrace: 50 * time.Millisecond,
+				MaxLeaked: 1,
+			})
+
+			for i := 0; i < 2; i++ {
+				timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+				_, err := client.Unary(timeoutCtx, &testpb.Message{Payload: "1"})
+				cancel()
+				Expect(status.Code(err)).To(Equal(codes.DeadlineExceeded))
+			}
+
+			Eventually(func() float64 {
+				return alerts.With(unaryMethod, "server", "leaked").Total()
+			}).Should(Equal(2.0))
+			Eventually(subject.Len).Should(Equal(1))
+			Expect(subject.Snapshot()[0].Leaked).To(BeTrue())
+		})
+
+		It("applies series limit to alerts", func() {
+			setup(new(testpb.TestServerImpl))
+			startWatchdog(WatchdogConfig{})
+
+			stream := openStream(ctx)
+			calls := subject.Snapshot()
+			Expect(calls).To(HaveLen(2))
+
+			handler := InstrumentWatchdogAlerts(alerts, WithSeriesLimit(1))
+			for _, call := range calls {
+				handler(WatchdogAlertStuck, call)
+			}
+			Expect(alerts.NumMetrics()).To(Equal(2))
+			Expect(alerts.With(streamMethod, calls[0].Side, "stuck").Total()).To(Equal(1.0))
+			Expect(alerts.With("other", "other", "other").Total()).To(Equal(1.0))
+
+			Expect(stream.CloseSend()).To(Succeed())
+			clientClose()
+		})
+	})
+})
@@ -0,0 +1,29 @@
+package omgrpc_test
+
+import "testing"
+
+func BenchmarkUnaryCall(b *testing.B) {
+	handler := newTypicalHandler()
+	call := newMockCall(unaryMethod)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			call.run(handler, 1)
+		}
+	})
+}
+
+func BenchmarkStreamingCall(b *testing.B) {
+	handler := newTypicalHandler()
+	call := newMockCall(streamMethod)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			call.run(handler, 10)
+		}
+	})
+}
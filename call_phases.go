@@ -0,0 +1,56 @@
+package omgrpc
+
+import (
+	"time"
+)
+
+// Call phases, populated for "phase" label by InstrumentCallPhaseDuration.
+const (
+	// CallPhaseQueue is the time from call begin till request headers are sent (client)
+	// or from receiving request headers till call begin (server),
+	// it includes name resolution, transport picking and waiting for stream quota.
+	CallPhaseQueue = "queue"
+	// CallPhaseFirstResponse is the time from call begin till response headers are received (client) or sent (server),
+	// for unary server calls it's mostly handler processing time.
+	CallPhaseFirstResponse = "first_response"
+	// CallPhaseResponseStream is the time from the first response message till call end.
+	CallPhaseResponseStream = "response_stream"
+)
+
+// callPhases lists call phases in order.
+var callPhases = []string{
+	CallPhaseQueue,
+	CallPhaseFirstResponse,
+	CallPhaseResponseStream,
+}
+
+// PhaseDuration is a convenience method that returns duration of the call phase
+// (one of CallPhase* constants) or false, if phase is unknown or did not happen (for example, no response was sent).
+func (s *CallStats) PhaseDuration(phase string) (time.Duration, bool) {
+	var start, end time.Time
+	switch phase {
+	case CallPhaseQueue:
+		if s.IsClient {
+			start, end = s.BeginTime, s.OutHeaderTime
+		} else {
+			start, end = s.InHeaderTime, s.BeginTime
+		}
+	case CallPhaseFirstResponse:
+		if s.IsClient {
+			start, end = s.BeginTime, s.InHeaderTime
+		} else {
+			start, end = s.BeginTime, s.OutHeaderTime
+		}
+	case CallPhaseResponseStream:
+		if s.IsClient {
+			start, end = s.InPayloadTime, s.EndTime
+		} else {
+			start, end = s.OutPayloadTime, s.EndTime
+		}
+	}
+
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0, false
+	}
+	return end.Sub(start), true
+}
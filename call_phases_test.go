@@ -0,0 +1,139 @@
+package omgrpc_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("CallStats.PhaseDuration", func() {
+	begin := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return begin.Add(time.Duration(ms) * time.Millisecond) }
+	phaseMillis := func(s CallStats, phase string) int {
+		d, ok := s.PhaseDuration(phase)
+		Expect(ok).To(BeTrue())
+		return int(d / time.Millisecond)
+	}
+
+	It("calculates client phases", func() {
+		s := CallStats{
+			IsClient:      true,
+			BeginTime:     at(0),
+			OutHeaderTime: at(2),
+			InHeaderTime:  at(10),
+			InPayloadTime: at(11),
+			EndTime:       at(15),
+		}
+		Expect(phaseMillis(s, CallPhaseQueue)).To(Equal(2))
+		Expect(phaseMillis(s, CallPhaseFirstResponse)).To(Equal(10))
+		Expect(phaseMillis(s, CallPhaseResponseStream)).To(Equal(4))
+	})
+
+	It("calculates server phases", func() {
+		s := CallStats{
+			InHeaderTime:   at(0),
+			BeginTime:      at(1),
+			OutHeaderTime:  at(8),
+			OutPayloadTime: at(8),
+			EndTime:        at(9),
+		}
+		Expect(phaseMillis(s, CallPhaseQueue)).To(Equal(1))
+		Expect(phaseMillis(s, CallPhaseFirstResponse)).To(Equal(7))
+		Expect(phaseMillis(s, CallPhaseResponseStream)).To(Equal(1))
+	})
+
+	It("skips phases, that did not happen", func() {
+		s := CallStats{IsClient: true, BeginTime: at(0), OutHeaderTime: at(1), EndTime: at(5)}
+		_, ok := s.PhaseDuration(CallPhaseFirstResponse)
+		Expect(ok).To(BeFalse())
+		_, ok = s.PhaseDuration(CallPhaseResponseStream)
+		Expect(ok).To(BeFalse())
+		_, ok = s.PhaseDuration("bad")
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("InstrumentCallPhaseDuration", func() {
+	var (
+		ctx = context.Background()
+
+		phases      openmetrics.HistogramFamily
+		client      testpb.TestClient
+		clientClose func()
+		teardown    func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		phases = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_call_phase",
+			Unit:   "seconds",
+			Labels: []string{"side", "phase"},
+		}, []float64{.1, 1})
+
+		handler := InstrumentCallPhaseDuration(phases)
+		client, clientClose, teardown = initClientServerSystem(
+			[]grpc.DialOption{grpc.WithStatsHandler(handler)},
+			[]grpc.ServerOption{grpc.StatsHandler(handler)},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("observes call phases", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+		clientClose()
+
+		Expect(phases.NumMetrics()).To(Equal(6))
+		for _, side := range []string{"client", "server"} {
+			for _, phase := range []string{"queue", "first_response", "response_stream"} {
+				Expect(phases.With(side, phase).Count()).To(Equal(int64(1)), "side: %s, phase: %s", side, phase)
+			}
+		}
+	})
+
+	It("applies series limit to phases", func() {
+		limited := openmetrics.NewConsistentRegistry(mockTime).Histogram(openmetrics.Desc{
+			Name:   "grpc_call_phase",
+			Unit:   "seconds",
+			Labels: []string{"side", "phase"},
+		}, []float64{.1, 1})
+
+		handler := InstrumentCallPhaseDuration(limited, WithSeriesLimit(2))
+		client, clientClose, teardown := initClientServerSystem(
+			[]grpc.DialOption{grpc.WithStatsHandler(handler)},
+			nil,
+		)
+		defer teardown()
+
+		for i := 0; i < 2; i++ {
+			_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		clientClose()
+
+		Expect(limited.NumMetrics()).To(Equal(3))
+		Expect(limited.With("client", "queue").Count()).To(Equal(int64(2)))
+		Expect(limited.With("client", "first_response").Count()).To(Equal(int64(2)))
+		Expect(limited.With("other", "other").Count()).To(Equal(int64(2)))
+	})
+
+	It("requires phase label", func() {
+		Expect(func() {
+			InstrumentCallPhaseDuration(openmetrics.NewConsistentRegistry(mockTime).Histogram(openmetrics.Desc{
+				Name: "grpc_call_phase",
+			}, []float64{1}))
+		}).To(PanicWith(`omgrpc: metric "grpc_call_phase" has no label "phase"`))
+	})
+})
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/stats"
@@ -21,12 +22,34 @@ type CallStats struct {
 	FullMethodName                 string
 	IsClientStream, IsServerStream bool
 	BeginTime, EndTime             time.Time
+	Deadline                       time.Time // call context deadline (received as grpc-timeout on server), zero if none
 	InHeader, InTrailer            metadata.MD
 	OutHeader, OutTrailer          metadata.MD
 	LocalAddr, RemoteAddr          net.Addr
-	BytesRecv, BytesSent           int
+	BytesRecv, BytesSent           int // total wire length of received/sent messages (compressed, with gRPC framing)
+	MsgsRecv, MsgsSent             int // number of received/sent messages (payloads)
 
-	Error error // RPC call error, can be examined with s, _ := grpc/status.FromError(err); s.Code()
+	UncompressedBytesRecv, UncompressedBytesSent int    // total uncompressed length of received/sent messages
+	InCompression, OutCompression                string // compression (grpc-encoding) of received/sent messages, empty if none
+
+	// times of the first received/sent header and message (payload), zero if none:
+	InHeaderTime, InPayloadTime   time.Time
+	OutHeaderTime, OutPayloadTime time.Time
+
+	Error        error  // RPC call error, can be examined with s, _ := grpc/status.FromError(err); s.Code()
+	CancelSource string // what caused the call to be canceled, one of CancelSource* constants
+
+	Timeline CallTimeline // stats events, recorded only if enabled (see CallStatsHandler.WithTimeline)
+
+	msg     MessageStats // last message stats, reused to avoid allocations
+	groups  uint64       // bit mask of MultiHandler call groups, active for the call
+	details *callDetails // decoded status details, nil until requested
+}
+
+// callDetails holds known status details of the call error.
+type callDetails struct {
+	errorInfo *errdetails.ErrorInfo
+	retryInfo *errdetails.RetryInfo
 }
 
 // Duration is a convenience method that returns RPC call duration.
@@ -39,45 +62,247 @@ func (s *CallStats) Code() codes.Code {
 	return status.Code(s.Error)
 }
 
+// ErrorInfo is a convenience method to return google.rpc.ErrorInfo status detail of RPC error (nil if none).
+// Status details are decoded only once per call.
+func (s *CallStats) ErrorInfo() *errdetails.ErrorInfo {
+	return s.statusDetails().errorInfo
+}
+
+// RetryDelay is a convenience method to return google.rpc.RetryInfo status detail delay of RPC error.
+// It returns false if error has no RetryInfo detail.
+// Status details are decoded only once per call.
+func (s *CallStats) RetryDelay() (time.Duration, bool) {
+	retryInfo := s.statusDetails().retryInfo
+	if retryInfo == nil || retryInfo.RetryDelay == nil {
+		return 0, false
+	}
+	return retryInfo.RetryDelay.AsDuration(), true
+}
+
+func (s *CallStats) statusDetails() *callDetails {
+	if s.details != nil {
+		return s.details
+	}
+
+	s.details = new(callDetails)
+	if s.Error == nil {
+		return s.details
+	}
+
+	st, ok := status.FromError(s.Error)
+	if !ok {
+		return s.details
+	}
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.ErrorInfo:
+			if s.details.errorInfo == nil {
+				s.details.errorInfo = detail
+			}
+		case *errdetails.RetryInfo:
+			if s.details.retryInfo == nil {
+				s.details.retryInfo = detail
+			}
+		}
+	}
+	return s.details
+}
+
+// Budget is a convenience method that returns time left till deadline, when call began
+// (negative, if deadline was already exceeded), or false if call has no deadline.
+func (s *CallStats) Budget() (time.Duration, bool) {
+	if s.Deadline.IsZero() || s.BeginTime.IsZero() {
+		return 0, false
+	}
+	return s.Deadline.Sub(s.BeginTime), true
+}
+
 var callStatsPool = sync.Pool{
 	New: func() interface{} {
 		return new(CallStats)
 	},
 }
 
-var contextKeyCallStats struct{}
+type contextKeyCallStats struct{}
+
+// callRef links RPC context to (pooled) CallStats.
+//
+// grpc emits stream events from sending and receiving goroutines concurrently
+// (and OutPayload may even be emitted after End), so events are serialized per call
+// and the link is cleared, when call ends and CallStats is returned to the pool.
+type callRef struct {
+	mu   sync.Mutex
+	call *CallStats // nil, if call is filtered out or ended
+}
+
+// callContext carries callRef, it's the same as context.WithValue(ctx, contextKeyCallStats{}, &callRef{...}),
+// but with a single allocation; it may carry client call link to its connection as well (see setCallConn).
+type callContext struct {
+	context.Context
+	ref      callRef
+	conn     callConn
+	linkConn bool
+}
+
+func (c *callContext) Value(key interface{}) interface{} {
+	switch key {
+	case contextKeyCallStats{}:
+		return &c.ref
+	case contextKeyCallConn{}:
+		if c.linkConn {
+			return &c.conn
+		}
+	}
+	return c.Context.Value(key)
+}
 
-func setCallStats(ctx context.Context, call *CallStats) context.Context {
-	return context.WithValue(ctx, contextKeyCallStats, call)
+func setCallStats(ctx context.Context, call *CallStats, linkConn bool) context.Context {
+	return &callContext{Context: ctx, ref: callRef{call: call}, linkConn: linkConn}
 }
 
-func getCallStats(ctx context.Context) *CallStats {
-	// internal, expected to be used carefully and never panic:
-	return ctx.Value(contextKeyCallStats).(*CallStats)
+func getCallRef(ctx context.Context) *callRef {
+	// nil, if call is not tagged:
+	ref, _ := ctx.Value(contextKeyCallStats{}).(*callRef)
+	return ref
 }
 
 // --------------------------------------------------------------------------------------
 
 // CallStatsHandler implements https://pkg.go.dev/google.golang.org/grpc/stats#Handler for RPC calls.
+// It is invoked once the RPC call ends, with all the collected stats.
 // CallStats argument is reused (pooled), so pointer cannot be stored - copy instead.
 //
-// It assumes that stats.Handler methods are never called concurrently.
+// Events of a single call are serialized, so it's never called concurrently for the same call.
 type CallStatsHandler func(*CallStats)
 
 // TagRPC attaches omgrpc-internal data to RPC context.
 func (h CallStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return tagCallStats(ctx, info)
+}
+
+// HandleRPC processes the RPC stats.
+func (h CallStatsHandler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
+	handleCallStats(ctx, stat, callCallbacks{end: h})
+}
+
+// TagConn implements grpc/stats.Handler interface and does nothing.
+func (h CallStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn implements grpc/stats.Handler interface and does nothing.
+func (h CallStatsHandler) HandleConn(ctx context.Context, stat stats.ConnStats) {}
+
+// --------------------------------------------------------------------------------------
+
+// CallBeginHandler implements https://pkg.go.dev/google.golang.org/grpc/stats#Handler for RPC calls.
+// It is invoked once the RPC call begins, so only FullMethodName, FailFast, IsClient, BeginTime, Deadline,
+// IsClientStream and IsServerStream fields are populated.
+// CallStats argument is reused (pooled), so pointer cannot be stored - copy instead.
+//
+// Events of a single call are serialized, so it's never called concurrently for the same call.
+type CallBeginHandler func(*CallStats)
+
+// TagRPC attaches omgrpc-internal data to RPC context.
+func (h CallBeginHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return tagCallStats(ctx, info)
+}
+
+// HandleRPC processes the RPC stats.
+func (h CallBeginHandler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
+	handleCallStats(ctx, stat, callCallbacks{begin: h})
+}
+
+// TagConn implements grpc/stats.Handler interface and does nothing.
+func (h CallBeginHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn implements grpc/stats.Handler interface and does nothing.
+func (h CallBeginHandler) HandleConn(ctx context.Context, stat stats.ConnStats) {}
+
+// --------------------------------------------------------------------------------------
+
+// MessageStats holds single RPC message (payload) stats.
+type MessageStats struct {
+	IsRecv bool // indicates received (inbound) message, otherwise it's sent (outbound)
+
+	Length     int       // uncompressed payload length
+	WireLength int       // payload length on the wire (compressed, with gRPC framing)
+	Time       time.Time // time of receiving/sending
+}
+
+// MessageStatsHandler implements https://pkg.go.dev/google.golang.org/grpc/stats#Handler for RPC messages.
+// It is invoked for every received/sent message with call stats collected so far (RPC status is not known yet).
+// Both arguments are reused (pooled), so pointers cannot be stored - copy instead.
+//
+// Events of a single call are serialized, so it's never called concurrently for the same call.
+type MessageStatsHandler func(*CallStats, *MessageStats)
+
+// TagRPC attaches omgrpc-internal data to RPC context.
+func (h MessageStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return tagCallStats(ctx, info)
+}
+
+// HandleRPC processes the RPC stats.
+func (h MessageStatsHandler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
+	handleCallStats(ctx, stat, callCallbacks{message: h})
+}
+
+// TagConn implements grpc/stats.Handler interface and does nothing.
+func (h MessageStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn implements grpc/stats.Handler interface and does nothing.
+func (h MessageStatsHandler) HandleConn(ctx context.Context, stat stats.ConnStats) {}
+
+// --------------------------------------------------------------------------------------
+
+// callCallbacks holds call-related handlers, any of them can be nil.
+type callCallbacks struct {
+	begin   CallBeginHandler
+	message MessageStatsHandler
+	end     CallStatsHandler
+}
+
+func (cb *callCallbacks) isEmpty() bool {
+	return cb.begin == nil && cb.message == nil && cb.end == nil
+}
+
+func tagCallStats(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return setCallStats(ctx, newCallStats(ctx, info), false)
+}
+
+func newCallStats(ctx context.Context, info *stats.RPCTagInfo) *CallStats {
 	// this method is called before HandleRPC, init CallStats at this point:
 	call := callStatsPool.Get().(*CallStats)
 	call.FullMethodName = info.FullMethodName
 	call.FailFast = info.FailFast
-	return setCallStats(ctx, call)
+	if deadline, ok := ctx.Deadline(); ok {
+		call.Deadline = deadline
+	}
+	return call
 }
 
-// HandleRPC processes the RPC stats.
-func (h CallStatsHandler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
+func handleCallStats(ctx context.Context, stat stats.RPCStats, cb callCallbacks) {
+	ref := getCallRef(ctx)
+	if ref == nil {
+		return // not tagged
+	}
+
+	ref.mu.Lock()
+	defer ref.mu.Unlock()
+
 	// pretty much all of the RPCStats types are handled,
 	// so prepare CallStats once:
-	call := getCallStats(ctx)
+	call := ref.call
+	if call == nil {
+		return // filtered out or already ended
+	}
+	if cap(call.Timeline) != 0 {
+		call.recordEvent(stat)
+	}
 
 	switch s := stat.(type) {
 
@@ -86,9 +311,16 @@ func (h CallStatsHandler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
 		call.BeginTime = s.BeginTime
 		call.IsClientStream = s.IsClientStream
 		call.IsServerStream = s.IsServerStream
+		if cb.begin != nil {
+			cb.begin(call)
+		}
 
 	case *stats.InHeader:
 		call.InHeader = s.Header
+		call.InCompression = s.Compression
+		if call.InHeaderTime.IsZero() {
+			call.InHeaderTime = time.Now()
+		}
 		if !s.Client { // server
 			call.RemoteAddr = s.RemoteAddr
 			call.LocalAddr = s.LocalAddr
@@ -96,12 +328,25 @@ func (h CallStatsHandler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
 
 	case *stats.InPayload:
 		call.BytesRecv += s.WireLength
+		call.UncompressedBytesRecv += s.Length
+		call.MsgsRecv++
+		if call.InPayloadTime.IsZero() {
+			call.InPayloadTime = s.RecvTime
+		}
+		if cb.message != nil {
+			call.msg = MessageStats{IsRecv: true, Length: s.Length, WireLength: s.WireLength, Time: s.RecvTime}
+			cb.message(call, &call.msg)
+		}
 
 	case *stats.InTrailer:
 		call.InTrailer = s.Trailer
 
 	case *stats.OutHeader:
 		call.OutHeader = s.Header
+		call.OutCompression = s.Compression
+		if call.OutHeaderTime.IsZero() {
+			call.OutHeaderTime = time.Now()
+		}
 		if s.Client { // client
 			call.RemoteAddr = s.RemoteAddr
 			call.LocalAddr = s.LocalAddr
@@ -109,6 +354,15 @@ func (h CallStatsHandler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
 
 	case *stats.OutPayload:
 		call.BytesSent += s.WireLength
+		call.UncompressedBytesSent += s.Length
+		call.MsgsSent++
+		if call.OutPayloadTime.IsZero() {
+			call.OutPayloadTime = s.SentTime
+		}
+		if cb.message != nil {
+			call.msg = MessageStats{Length: s.Length, WireLength: s.WireLength, Time: s.SentTime}
+			cb.message(call, &call.msg)
+		}
 
 	case *stats.OutTrailer:
 		call.OutTrailer = s.Trailer
@@ -116,17 +370,16 @@ func (h CallStatsHandler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
 	case *stats.End:
 		call.EndTime = s.EndTime
 		call.Error = s.Error
-		h(call) // "submit" collected stats
+		if s.Client && call.InTrailer == nil {
+			call.InTrailer = s.Trailer // client InTrailer is reported after End
+		}
+		call.CancelSource = classifyCancelSource(ctx, call, s)
+		if cb.end != nil {
+			cb.end(call) // "submit" collected stats
+		}
+		ref.call = nil
 		*call = CallStats{}
 		callStatsPool.Put(call)
 
 	}
 }
-
-// TagConn implements grpc/stats.Handler interface and does nothing.
-func (h CallStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
-	return ctx
-}
-
-// HandleConn implements grpc/stats.Handler interface and does nothing.
-func (h CallStatsHandler) HandleConn(ctx context.Context, stat stats.ConnStats) {}
@@ -2,10 +2,13 @@ package omgrpc_test
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/bsm/omgrpc/internal/testpb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
 
 	. "github.com/bsm/omgrpc"
 
@@ -18,6 +21,7 @@ var _ = Describe("CallStatsHandler", func() {
 		ctx = context.Background()
 
 		subject         CallStatsHandler
+		mu              sync.Mutex // client and server submit stats concurrently
 		clientCallStats []CallStats
 		serverCallStats []CallStats
 		client          testpb.TestClient
@@ -30,6 +34,9 @@ var _ = Describe("CallStatsHandler", func() {
 		serverCallStats = serverCallStats[:0]
 
 		subject = CallStatsHandler(func(call *CallStats) {
+			mu.Lock()
+			defer mu.Unlock()
+
 			if call.IsClient {
 				clientCallStats = append(clientCallStats, *call)
 			} else {
@@ -79,6 +86,9 @@ var _ = Describe("CallStatsHandler", func() {
 
 		clientClose() // initiate Stream call to be closed by closing Client
 
+		mu.Lock()
+		defer mu.Unlock()
+
 		Expect(clientCallStats).To(HaveLen(2))
 		Expect(serverCallStats).To(HaveLen(2))
 
@@ -92,6 +102,12 @@ var _ = Describe("CallStatsHandler", func() {
 		Expect(s.IsServerStream).To(BeFalse())
 		Expect(s.BytesRecv).To(Equal(15))
 		Expect(s.BytesSent).To(Equal(8))
+		Expect(s.UncompressedBytesRecv).To(Equal(10))
+		Expect(s.UncompressedBytesSent).To(Equal(3))
+		Expect(s.InCompression).To(BeEmpty())
+		Expect(s.OutCompression).To(BeEmpty())
+		Expect(s.MsgsRecv).To(Equal(1))
+		Expect(s.MsgsSent).To(Equal(1))
 		Expect(s.Error).To(BeNil())
 
 		// client Stream:
@@ -102,6 +118,8 @@ var _ = Describe("CallStatsHandler", func() {
 		Expect(s.IsServerStream).To(BeTrue())
 		Expect(s.BytesRecv).To(Equal(32))
 		Expect(s.BytesSent).To(Equal(16))
+		Expect(s.MsgsRecv).To(Equal(2))
+		Expect(s.MsgsSent).To(Equal(2))
 		// basically, clientClose affects Client first, and only then Server, so we get this:
 		Expect(s.Error).To(MatchError(ContainSubstring("grpc: the client connection is closing")))
 
@@ -109,6 +127,7 @@ var _ = Describe("CallStatsHandler", func() {
 		Expect(s.BeginTime).To(BeTemporally("~", time.Now(), time.Second))
 		Expect(s.EndTime).To(BeTemporally("~", time.Now(), time.Second))
 		Expect(s.EndTime).To(BeTemporally(">", s.BeginTime))
+		Expect(s.Deadline).To(BeZero())
 		Expect(s.InHeader).NotTo(BeNil())   // just check that this is set; no assertions for InTrailer as they're rare and not used in this test
 		Expect(s.OutHeader).NotTo(BeNil())  // just check that this is set; no assertions for InTrailer as they're rare and not used in this test
 		Expect(s.LocalAddr).NotTo(BeNil())  // just check that this is set
@@ -122,6 +141,10 @@ var _ = Describe("CallStatsHandler", func() {
 		Expect(s.IsServerStream).To(BeFalse())
 		Expect(s.BytesRecv).To(Equal(8))
 		Expect(s.BytesSent).To(Equal(15))
+		Expect(s.UncompressedBytesRecv).To(Equal(3))
+		Expect(s.UncompressedBytesSent).To(Equal(10))
+		Expect(s.MsgsRecv).To(Equal(1))
+		Expect(s.MsgsSent).To(Equal(1))
 		Expect(s.Error).To(BeNil())
 
 		// server Stream:
@@ -132,6 +155,48 @@ var _ = Describe("CallStatsHandler", func() {
 		Expect(s.IsServerStream).To(BeTrue())
 		Expect(s.BytesRecv).To(Equal(16))
 		Expect(s.BytesSent).To(Equal(32))
+		Expect(s.MsgsRecv).To(Equal(2))
+		Expect(s.MsgsSent).To(Equal(2))
 		Expect(s.Error).To(BeNil())
 	})
+
+	It("accumulates stats of concurrent streams", func() {
+		const streams, msgs = 8, 100
+		runConcurrentStreams(ctx, client, streams, msgs)
+		clientClose()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		Expect(clientCallStats).To(HaveLen(streams))
+		Expect(serverCallStats).To(HaveLen(streams))
+		for _, s := range clientCallStats {
+			Expect(s.Error).To(BeNil())
+			Expect(s.MsgsSent).To(Equal(msgs))
+			Expect(s.MsgsRecv).To(Equal(msgs))
+			Expect(s.BytesSent).To(Equal(8 * msgs))
+			Expect(s.BytesRecv).To(Equal(16 * msgs))
+		}
+		for _, s := range serverCallStats {
+			Expect(s.Error).To(BeNil())
+			Expect(s.MsgsRecv).To(Equal(msgs))
+			Expect(s.MsgsSent).To(Equal(msgs))
+			Expect(s.BytesRecv).To(Equal(8 * msgs))
+			Expect(s.BytesSent).To(Equal(16 * msgs))
+		}
+	})
+
+	It("populates client trailer, that is reported after End", func() {
+		trailer := metadata.Pairs("x-retry", "1")
+		ctx := subject.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: unaryMethod})
+		subject.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: mockTime()})
+		subject.HandleRPC(ctx, &stats.End{Client: true, EndTime: mockTime(), Trailer: trailer})
+		subject.HandleRPC(ctx, &stats.InTrailer{Client: true, Trailer: trailer}) // ignored
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		Expect(clientCallStats).To(HaveLen(1))
+		Expect(clientCallStats[0].InTrailer).To(Equal(trailer))
+	})
 })
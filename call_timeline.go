@@ -0,0 +1,116 @@
+package omgrpc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/stats"
+)
+
+// CallEvent holds a single RPC stats event.
+type CallEvent struct {
+	Type       string    // event type: "Begin", "InHeader", "InPayload", "InTrailer", "OutHeader", "OutPayload", "OutTrailer" or "End"
+	Time       time.Time // time of the event (for headers and trailers - time of handling)
+	Length     int       // uncompressed payload length (payloads only)
+	WireLength int       // length on the wire (compressed, with gRPC framing), if known
+}
+
+// CallTimeline holds RPC stats events in order (see CallStatsHandler.WithTimeline).
+type CallTimeline []CallEvent
+
+// String renders the timeline as a waterfall, one event per line with offset from the first event:
+//
+//	+0s        |*                   | Begin
+//	+210µs     |*                   | OutHeader
+//	+250µs     |*                   | OutPayload length=8 wire=13
+//	+4.1ms     |                  * | InHeader wire=12
+//	...
+func (t CallTimeline) String() string {
+	if len(t) == 0 {
+		return ""
+	}
+
+	const width = 20
+	start := t[0].Time
+	total := t[len(t)-1].Time.Sub(start)
+
+	var b strings.Builder
+	for _, e := range t {
+		offset := e.Time.Sub(start)
+
+		pos := 0
+		if total > 0 {
+			pos = int(int64(width-1) * int64(offset) / int64(total))
+		}
+		if pos < 0 {
+			pos = 0
+		} else if pos >= width {
+			pos = width - 1
+		}
+
+		fmt.Fprintf(&b, "%-10s |%s*%s| %s", "+"+offset.String(), strings.Repeat(" ", pos), strings.Repeat(" ", width-1-pos), e.Type)
+		if e.Length != 0 {
+			fmt.Fprintf(&b, " length=%d", e.Length)
+		}
+		if e.WireLength != 0 {
+			fmt.Fprintf(&b, " wire=%d", e.WireLength)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// WithTimeline returns a handler, that makes CallStats record up to limit stats events into Timeline;
+// events over the limit are dropped.
+// Timeline is recorded for all the handlers, combined with this one by Instrument:
+//
+//	omgrpc.Instrument(
+//	  omgrpc.InstrumentCallDuration(callDuration),
+//	  omgrpc.CallStatsHandler(func(call *omgrpc.CallStats) {
+//	    if call.Duration() > time.Second {
+//	      log.Printf("slow call %s:\n%s", call.FullMethodName, call.Timeline)
+//	    }
+//	  }).WithTimeline(32),
+//	)
+//
+// Timeline is allocated per call, so it's not recommended for high-traffic services.
+func (h CallStatsHandler) WithTimeline(limit int) stats.Handler {
+	m := new(MultiHandler)
+	m.add(h)
+	m.timelineLimit = limit
+	m.compile()
+	return m
+}
+
+// ----------------------------------------------------------------------------
+
+// recordEvent appends stats event to the call timeline, if it's enabled and not full.
+func (s *CallStats) recordEvent(stat stats.RPCStats) {
+	if len(s.Timeline) == cap(s.Timeline) {
+		return // disabled or full
+	}
+
+	var e CallEvent
+	switch st := stat.(type) {
+	case *stats.Begin:
+		e = CallEvent{Type: "Begin", Time: st.BeginTime}
+	case *stats.InHeader:
+		e = CallEvent{Type: "InHeader", Time: time.Now(), WireLength: st.WireLength}
+	case *stats.InPayload:
+		e = CallEvent{Type: "InPayload", Time: st.RecvTime, Length: st.Length, WireLength: st.WireLength}
+	case *stats.InTrailer:
+		e = CallEvent{Type: "InTrailer", Time: time.Now(), WireLength: st.WireLength}
+	case *stats.OutHeader:
+		e = CallEvent{Type: "OutHeader", Time: time.Now()}
+	case *stats.OutPayload:
+		e = CallEvent{Type: "OutPayload", Time: st.SentTime, Length: st.Length, WireLength: st.WireLength}
+	case *stats.OutTrailer:
+		e = CallEvent{Type: "OutTrailer", Time: time.Now()}
+	case *stats.End:
+		e = CallEvent{Type: "End", Time: st.EndTime}
+	default:
+		return
+	}
+	s.Timeline = append(s.Timeline, e)
+}
@@ -0,0 +1,115 @@
+package omgrpc_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"google.golang.org/grpc"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("CallStatsHandler.WithTimeline", func() {
+	var (
+		ctx = context.Background()
+
+		mu        sync.Mutex // client and server submit stats concurrently
+		timelines []CallTimeline
+		untracked []CallTimeline
+		client    testpb.TestClient
+		teardown  func()
+	)
+
+	eventTypes := func(t CallTimeline) []string {
+		types := make([]string, 0, len(t))
+		for _, e := range t {
+			types = append(types, e.Type)
+		}
+		return types
+	}
+
+	setup := func(limit int) {
+		timelines = timelines[:0]
+		untracked = untracked[:0]
+
+		client, _, teardown = initClientServerSystem(
+			[]grpc.DialOption{
+				grpc.WithStatsHandler(Instrument(
+					CallStatsHandler(func(call *CallStats) {
+						mu.Lock()
+						defer mu.Unlock()
+						timelines = append(timelines, call.Timeline)
+					}).WithTimeline(limit),
+				)),
+			},
+			[]grpc.ServerOption{
+				grpc.StatsHandler(CallStatsHandler(func(call *CallStats) {
+					mu.Lock()
+					defer mu.Unlock()
+					untracked = append(untracked, call.Timeline)
+				})),
+			},
+		)
+	}
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("records call events", func() {
+		setup(16)
+
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(timelines).To(HaveLen(1))
+		Expect(eventTypes(timelines[0])).To(Equal([]string{
+			"Begin", "OutHeader", "OutPayload", "InHeader", "InTrailer", "InPayload", "End", // unary payload is reported after trailer
+		}))
+		Expect(timelines[0][2].Length).To(Equal(3))
+		Expect(timelines[0][2].WireLength).To(Equal(8))
+		Expect(timelines[0][0].Time).NotTo(BeZero())
+		Expect(timelines[0].String()).To(ContainSubstring("| OutPayload length=3 wire=8\n"))
+
+		Eventually(func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(untracked)
+		}).Should(Equal(1))
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(untracked[0]).To(BeNil())
+	})
+
+	It("limits the number of events", func() {
+		setup(3)
+
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(timelines).To(HaveLen(1))
+		Expect(eventTypes(timelines[0])).To(Equal([]string{"Begin", "OutHeader", "OutPayload"}))
+	})
+})
+
+var _ = Describe("CallTimeline", func() {
+	It("renders waterfall", func() {
+		begin := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		t := CallTimeline{
+			{Type: "Begin", Time: begin},
+			{Type: "OutPayload", Time: begin.Add(time.Millisecond), Length: 3, WireLength: 8},
+			{Type: "End", Time: begin.Add(19 * time.Millisecond)},
+		}
+		Expect(t.String()).To(Equal("" +
+			"+0s        |*                   | Begin\n" +
+			"+1ms       | *                  | OutPayload length=3 wire=8\n" +
+			"+19ms      |                   *| End\n",
+		))
+		Expect(CallTimeline(nil).String()).To(BeEmpty())
+	})
+})
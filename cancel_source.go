@@ -0,0 +1,50 @@
+package omgrpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+)
+
+// Cancel sources, populated for "cancel_source" label (see CallStats.CancelSource).
+//
+// Client connection errors are recognized by grpc transport error messages, which are verified for grpc 1.40 only
+// (see DisconnectReason* constants); with other grpc versions only closed client connections are reported
+// as "connection", and lost connections are reported as "server".
+const (
+	CancelSourceNone       = "none"       // call was not canceled
+	CancelSourceClient     = "client"     // caller canceled the call (on server side: or connection was lost or client deadline came first)
+	CancelSourceDeadline   = "deadline"   // call deadline exceeded
+	CancelSourceConnection = "connection" // client connection was closed or lost before status was received
+	CancelSourceServer     = "server"     // server returned Canceled, DeadlineExceeded or Unavailable status itself
+)
+
+// ----------------------------------------------------------------------------
+
+// classifyCancelSource returns cancel source of the ended call, ctx is the call context.
+func classifyCancelSource(ctx context.Context, call *CallStats, end *stats.End) string {
+	switch call.Code() {
+	case codes.Canceled, codes.DeadlineExceeded, codes.Unavailable:
+	default:
+		return CancelSourceNone
+	}
+
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return CancelSourceDeadline
+	case context.Canceled:
+		// server stream context is canceled both when client cancels the call and when connection is lost,
+		// and there is no way to distinguish these cases;
+		// also client cancels the call on its deadline, which may come before server one:
+		return CancelSourceClient
+	}
+
+	// call context is still active; client InTrailer may be reported after End, so status origin is derived
+	// from End: server trailer metadata means status was received from server,
+	// otherwise it's derived from the error, which client connection produces when it's closed or lost:
+	if end.Client && len(end.Trailer) == 0 && classifyTransportError(end.Error) != transportErrorNone {
+		return CancelSourceConnection
+	}
+	return CancelSourceServer
+}
@@ -0,0 +1,160 @@
+package omgrpc_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("CancelSource", func() {
+	var (
+		ctx = context.Background()
+
+		calls       openmetrics.CounterFamily
+		server      *grpc.Server
+		client      testpb.TestClient
+		clientClose func()
+		teardown    func()
+	)
+
+	setup := func(serverImpl *testpb.TestServerImpl) {
+		calls = openmetrics.NewConsistentRegistry(mockTime).Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"method", "side", "cancel_source"},
+		})
+
+		handler := InstrumentCallCount(calls)
+		server, client, clientClose, teardown = initClientServerSystemWithServer(
+			serverImpl,
+			[]grpc.DialOption{grpc.WithStatsHandler(handler)},
+			[]grpc.ServerOption{grpc.StatsHandler(handler)},
+		)
+	}
+
+	openStream := func(ctx context.Context) testpb.Test_StreamClient {
+		stream, err := client.Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.Send(&testpb.Message{Payload: "1"})).To(Succeed())
+		_, err = stream.Recv()
+		Expect(err).NotTo(HaveOccurred())
+		return stream
+	}
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("classifies successful calls", func() {
+		setup(new(testpb.TestServerImpl))
+
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+		clientClose()
+
+		Expect(calls.With(unaryMethod, "client", "none").Total()).To(Equal(1.0))
+		Expect(calls.With(unaryMethod, "server", "none").Total()).To(Equal(1.0))
+	})
+
+	It("classifies client cancellation", func() {
+		setup(new(testpb.TestServerImpl))
+
+		cancelCtx, cancel := context.WithCancel(ctx)
+		stream := openStream(cancelCtx)
+		cancel()
+		_, err := stream.Recv()
+		Expect(status.Code(err)).To(Equal(codes.Canceled))
+		clientClose()
+
+		Expect(calls.With(streamMethod, "client", "client").Total()).To(Equal(1.0))
+		Expect(calls.With(streamMethod, "server", "client").Total()).To(Equal(1.0))
+	})
+
+	It("classifies exceeded deadlines", func() {
+		setup(new(testpb.TestServerImpl))
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		stream := openStream(timeoutCtx)
+		_, err := stream.Recv()
+		Expect(status.Code(err)).To(Equal(codes.DeadlineExceeded))
+		clientClose()
+
+		Expect(calls.With(streamMethod, "client", "deadline").Total()).To(Equal(1.0))
+		// client cancels the call on deadline as well, which may race with server deadline:
+		Expect(calls.With(streamMethod, "server", "deadline").Total() +
+			calls.With(streamMethod, "server", "client").Total()).To(Equal(1.0))
+	})
+
+	It("classifies closed connections", func() {
+		setup(new(testpb.TestServerImpl))
+
+		openStream(ctx)
+		clientClose()
+
+		Expect(calls.With(streamMethod, "client", "connection").Total()).To(Equal(1.0))
+		Expect(calls.With(streamMethod, "server", "client").Total()).To(Equal(1.0))
+	})
+
+	It("classifies lost connections", func() {
+		// relies on real grpc transport errors, so it fails, when their messages drift:
+		setup(new(testpb.TestServerImpl))
+
+		stream := openStream(ctx)
+		server.Stop()
+		_, err := stream.Recv()
+		Expect(status.Code(err)).To(Equal(codes.Unavailable))
+
+		Expect(calls.With(streamMethod, "client", "connection").Total()).To(Equal(1.0))
+		Eventually(func() float64 {
+			return calls.With(streamMethod, "server", "client").Total()
+		}).Should(Equal(1.0))
+	})
+
+	It("classifies server statuses", func() {
+		setup(&testpb.TestServerImpl{UnaryError: status.Error(codes.DeadlineExceeded, "downstream timeout")})
+
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(status.Code(err)).To(Equal(codes.DeadlineExceeded))
+		clientClose()
+
+		Expect(calls.With(unaryMethod, "client", "server").Total()).To(Equal(1.0))
+		Expect(calls.With(unaryMethod, "server", "server").Total()).To(Equal(1.0))
+	})
+
+	It("classifies client calls, which receive InTrailer after End", func() {
+		calls = openmetrics.NewConsistentRegistry(mockTime).Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"side", "cancel_source"},
+		})
+		handler := InstrumentCallCount(calls)
+		teardown = func() {}
+
+		// grpc client reports InTrailer after End:
+		run := func(err error, trailer metadata.MD) {
+			ctx := handler.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: unaryMethod})
+			handler.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: mockTime()})
+			handler.HandleRPC(ctx, &stats.OutHeader{Client: true})
+			handler.HandleRPC(ctx, &stats.End{Client: true, EndTime: mockTime(), Error: err, Trailer: trailer})
+			handler.HandleRPC(ctx, &stats.InTrailer{Client: true, Trailer: trailer})
+		}
+		run(status.Error(codes.Unavailable, "overloaded"), metadata.MD{})
+		run(status.Error(codes.Unavailable, "transport is closing"), metadata.Pairs("x-reason", "restart"))
+		run(status.Error(codes.Unavailable, "error reading from server: EOF"), metadata.MD{})
+		run(status.Error(codes.Canceled, "grpc: the client connection is closing"), metadata.MD{})
+
+		Expect(calls.With("client", "server").Total()).To(Equal(2.0))
+		Expect(calls.With("client", "connection").Total()).To(Equal(2.0))
+	})
+})
@@ -0,0 +1,151 @@
+package omgrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// ConnInfo holds a point-in-time copy of an active connection stats.
+type ConnInfo struct {
+	ID           uint64    `json:"id"`
+	Side         string    `json:"side"` // "client" or "server"
+	LocalAddr    string    `json:"local_addr"`
+	RemoteAddr   string    `json:"remote_addr"`
+	BeginTime    time.Time `json:"begin_time"`
+	BytesRecv    int64     `json:"bytes_recv"`
+	BytesSent    int64     `json:"bytes_sent"`
+	ActiveCalls  int       `json:"active_calls"`
+	LastActivity time.Time `json:"last_activity"` // time of the last call event, zero if there were no calls
+}
+
+// ConnRegistry keeps track of active gRPC connections for debugging.
+// It is fed by its StatsHandler and is safe for concurrent use:
+//
+//	conns := omgrpc.NewConnRegistry()
+//	srv := grpc.NewServer(grpc.StatsHandler(omgrpc.Instrument(
+//	  conns.StatsHandler(),
+//	  omgrpc.InstrumentActiveConns(activeConns),
+//	)))
+//	http.Handle("/debug/grpc/conns", conns)
+//
+// ConnRegistry implements http.Handler, which renders active connections as JSON
+// or as a plain-text table, when requested with "?format=text".
+type ConnRegistry struct {
+	conns map[*connState]*connEntry
+	mu    sync.RWMutex
+}
+
+// connEntry is a ConnRegistry entry.
+type connEntry struct {
+	info ConnInfo   // identity fields, copied when connected
+	live *connState // shared with connection
+}
+
+// NewConnRegistry returns a new ConnRegistry.
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: make(map[*connState]*connEntry)}
+}
+
+// StatsHandler returns a stats.Handler, that registers connections when connected
+// and unregisters them when disconnected.
+func (r *ConnRegistry) StatsHandler() ConnStatsHandler {
+	return r.handleConn
+}
+
+func (r *ConnRegistry) handleConn(conn *ConnStats) {
+	switch conn.Status {
+	case Connected:
+		entry := &connEntry{info: ConnInfo{
+			ID:         conn.ID,
+			Side:       sideName(conn.IsClient),
+			LocalAddr:  addrString(conn.LocalAddr),
+			RemoteAddr: addrString(conn.RemoteAddr),
+			BeginTime:  conn.BeginTime,
+		}, live: conn.live}
+
+		r.mu.Lock()
+		r.conns[conn.live] = entry
+		r.mu.Unlock()
+	case Disconnected:
+		r.mu.Lock()
+		delete(r.conns, conn.live)
+		r.mu.Unlock()
+	}
+}
+
+// Len returns the number of active connections.
+func (r *ConnRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.conns)
+}
+
+// Snapshot returns copies of active connection stats, ordered by ID.
+func (r *ConnRegistry) Snapshot() []ConnInfo {
+	r.mu.RLock()
+	infos := make([]ConnInfo, 0, len(r.conns))
+	for _, entry := range r.conns {
+		infos = append(infos, entry.snapshot())
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// ServeHTTP renders active connections as JSON (default) or as a plain-text table ("?format=text").
+func (r *ConnRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	infos := r.Snapshot()
+
+	if req.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeConnTable(w, infos, time.Now())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(infos)
+}
+
+// ----------------------------------------------------------------------------
+
+func (e *connEntry) snapshot() ConnInfo {
+	info := e.info
+	info.BytesRecv = atomic.LoadInt64(&e.live.bytesRecv)
+	info.BytesSent = atomic.LoadInt64(&e.live.bytesSent)
+	info.ActiveCalls = int(atomic.LoadInt32(&e.live.activeCalls))
+	if nanos := atomic.LoadInt64(&e.live.lastActivity); nanos != 0 {
+		info.LastActivity = time.Unix(0, nanos)
+	}
+	return info
+}
+
+func writeConnTable(w http.ResponseWriter, infos []ConnInfo, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSIDE\tLOCAL\tREMOTE\tAGE\tRECV\tSENT\tCALLS\tIDLE")
+	for _, info := range infos {
+		idle := "-"
+		if !info.LastActivity.IsZero() {
+			idle = now.Sub(info.LastActivity).Truncate(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			info.ID,
+			info.Side,
+			info.LocalAddr,
+			info.RemoteAddr,
+			now.Sub(info.BeginTime).Truncate(time.Millisecond),
+			info.BytesRecv,
+			info.BytesSent,
+			info.ActiveCalls,
+			idle,
+		)
+	}
+	_ = tw.Flush()
+}
@@ -0,0 +1,102 @@
+package omgrpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"google.golang.org/grpc"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("ConnRegistry", func() {
+	var (
+		ctx = context.Background()
+
+		subject     *ConnRegistry
+		client      testpb.TestClient
+		clientClose func()
+		teardown    func()
+	)
+
+	BeforeEach(func() {
+		subject = NewConnRegistry()
+		client, clientClose, teardown = initClientServerSystem(
+			[]grpc.DialOption{grpc.WithStatsHandler(subject.StatsHandler())},
+			[]grpc.ServerOption{grpc.StatsHandler(subject.StatsHandler())},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("tracks active connections", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(subject.Len).Should(Equal(2))
+
+		infos := subject.Snapshot()
+		Expect(infos).To(HaveLen(2))
+		Expect(infos[0].ID).To(BeNumerically("<", infos[1].ID))
+
+		var clientInfo ConnInfo
+		for _, info := range infos {
+			if info.Side == "client" {
+				clientInfo = info
+			}
+		}
+		Expect(clientInfo.Side).To(Equal("client"))
+		Expect(clientInfo.RemoteAddr).To(Equal("bufconn"))
+		Expect(clientInfo.BeginTime).NotTo(BeZero())
+		Expect(clientInfo.BytesRecv).To(BeNumerically(">", 8)) // includes headers and trailers
+		Expect(clientInfo.BytesSent).To(Equal(int64(8)))
+		Expect(clientInfo.ActiveCalls).To(Equal(0))
+		Expect(clientInfo.LastActivity).NotTo(BeZero())
+
+		clientClose()
+		Eventually(subject.Len).Should(Equal(0))
+	})
+
+	It("counts calls in flight", func() {
+		stream, err := client.Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.Send(&testpb.Message{Payload: "1"})).To(Succeed())
+		_, err = stream.Recv()
+		Expect(err).NotTo(HaveOccurred())
+
+		infos := subject.Snapshot()
+		Expect(infos).To(HaveLen(2))
+		Expect(infos[0].ActiveCalls).To(Equal(1))
+		Expect(infos[1].ActiveCalls).To(Equal(1))
+
+		Expect(stream.CloseSend()).To(Succeed())
+		clientClose()
+	})
+
+	It("serves JSON and plain-text", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(subject.Len).Should(Equal(2))
+
+		w := httptest.NewRecorder()
+		subject.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var infos []ConnInfo
+		Expect(json.Unmarshal(w.Body.Bytes(), &infos)).To(Succeed())
+		Expect(infos).To(HaveLen(2))
+
+		w = httptest.NewRecorder()
+		subject.ServeHTTP(w, httptest.NewRequest("GET", "/?format=text", nil))
+		Expect(w.Header().Get("Content-Type")).To(HavePrefix("text/plain"))
+		Expect(w.Body.String()).To(MatchRegexp(`^ID +SIDE +LOCAL +REMOTE +AGE +RECV +SENT +CALLS +IDLE\n`))
+		Expect(w.Body.String()).To(ContainSubstring("client"))
+		Expect(w.Body.String()).To(ContainSubstring("server"))
+	})
+})
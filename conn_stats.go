@@ -3,8 +3,12 @@ package omgrpc
 import (
 	"context"
 	"net"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/stats"
 )
 
@@ -18,11 +22,22 @@ const (
 
 // ConnStats holds connection stats.
 type ConnStats struct {
-	IsClient bool // indicates client-side stats
+	ID       uint64 // process-wide unique connection ID
+	IsClient bool   // indicates client-side stats
 	Status   ConnStatus
 
 	LocalAddr, RemoteAddr net.Addr
-	BytesRecv, BytesSent  int // supported only for server side, only when Connected=false
+	BeginTime, EndTime    time.Time // EndTime is populated only when Connected=false
+	BytesRecv, BytesSent  int       // populated only when Connected=false, see InstrumentConnBytes for client-side limitations
+	Calls                 int       // number of started RPC calls (retried ones are counted once), populated only when Connected=false
+	DisconnectReason      string    // one of DisconnectReason* constants, populated only when Connected=false and IsClient=true
+
+	live *connState // shared with connection calls
+}
+
+// Duration is a convenience method that returns connection duration (age, when disconnected).
+func (s *ConnStats) Duration() time.Duration {
+	return s.EndTime.Sub(s.BeginTime)
 }
 
 var connStatsPool = sync.Pool{
@@ -31,80 +46,449 @@ var connStatsPool = sync.Pool{
 	},
 }
 
-var contextKeyConnStats struct{}
+// connState holds connection state, shared by connection calls and ConnRegistry.
+// It is not pooled, as calls, that were in flight, may still update it after connection ends
+// (64-bit fields go first to keep them aligned on 32-bit platforms).
+type connState struct {
+	// counters, accessed concurrently by transport and calls:
+	bytesRecv, bytesSent int64
+	calls                int64
+	lastActivity         int64 // time of the last call event, unix nanoseconds
+	activeCalls          int32 // number of calls in flight
+	ended                int32 // set, when connection ends (client-side only)
+	reported             int32 // set, when disconnect is reported
+	disconnectHint       int32 // disconnect reason, derived from failed calls
+
+	// set when connection begins and ends:
+	id                    uint64
+	isClient              bool
+	localAddr, remoteAddr net.Addr
+	beginTime, endTime    time.Time
+}
+
+// lastConnID is the last assigned ConnStats.ID.
+var lastConnID uint64
 
-func setConnStats(ctx context.Context, conn *ConnStats) context.Context {
-	return context.WithValue(ctx, contextKeyConnStats, conn)
+type contextKeyConnStats struct{}
+
+// connContext carries connState, it's the same as context.WithValue(ctx, contextKeyConnStats{}, &connState{...}),
+// but with a single allocation.
+type connContext struct {
+	context.Context
+	state connState
 }
 
-func getConnStats(ctx context.Context) *ConnStats {
+func (c *connContext) Value(key interface{}) interface{} {
+	if key == (contextKeyConnStats{}) {
+		return &c.state
+	}
+	return c.Context.Value(key)
+}
+
+func getConnState(ctx context.Context) *connState {
 	// internal, expected to be used carefully and never panic:
-	return ctx.Value(contextKeyConnStats).(*ConnStats)
+	return ctx.Value(contextKeyConnStats{}).(*connState)
+}
+
+// client RPC context is not derived from connection context (unlike server one),
+// so client call is linked to its connection by addresses, when headers are sent.
+type contextKeyCallConn struct{}
+
+type callConn struct {
+	conn  atomic.Value // *connState, stored when headers are sent (sending and receiving goroutines race on it)
+	state int32        // one of callConn* constants
+}
+
+const (
+	callConnIdle   int32 = iota // not counted as connection active call
+	callConnActive              // counted as connection active call
+	callConnEnded               // call ended
+)
+
+// attach links client call to the connection, it's invoked when headers are sent, once per call attempt.
+// Attempts may be retried transparently (even when retries are disabled), on the same connection or another one,
+// before or after End of the previous attempt, so the call is moved to the connection of the last attempt.
+func (link *callConn) attach(conn *connState, cb *connCallbacks) {
+	prev, _ := link.conn.Load().(*connState)
+	if conn == prev {
+		return // already attached
+	}
+
+	if prev != nil {
+		atomic.AddInt64(&prev.calls, -1)
+		if atomic.CompareAndSwapInt32(&link.state, callConnActive, callConnIdle) {
+			prev.endCall(cb)
+		}
+	}
+	if conn != nil {
+		atomic.AddInt64(&conn.calls, 1)
+		if atomic.CompareAndSwapInt32(&link.state, callConnIdle, callConnActive) {
+			atomic.AddInt32(&conn.activeCalls, 1)
+		}
+	}
+	link.conn.Store(conn) // may be nil, when connection is not known
+}
+
+// end marks client call as ended and reports whether it was counted as connection active call.
+func (link *callConn) end() bool {
+	return atomic.SwapInt32(&link.state, callConnEnded) == callConnActive
+}
+
+// setCallConn attaches client call link to RPC context, server calls are left as is,
+// as they are linked to their connections by context.
+func setCallConn(ctx context.Context) context.Context {
+	if isServerRPC(ctx) {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKeyCallConn{}, new(callConn))
+}
+
+// isServerRPC reports whether RPC context, passed to TagRPC, belongs to server call: it's derived from server
+// connection context, but not from server call context, as client calls, made by server handlers, are.
+func isServerRPC(ctx context.Context) bool {
+	return ctx.Value(contextKeyConnStats{}) != nil && grpc.ServerTransportStreamFromContext(ctx) == nil
+}
+
+func getCallConn(ctx context.Context) *callConn {
+	link, _ := ctx.Value(contextKeyCallConn{}).(*callConn)
+	return link
 }
 
 // ----------------------------------------------------------------------------
 
 // ConnStatsHandler implements https://pkg.go.dev/google.golang.org/grpc/stats#Handler for RPC connections.
 // ConnStats argument is reused (pooled), so pointer cannot be stored - copy instead.
+// Disconnect is reported synchronously, when grpc reports it, unless a grace period is set
+// by MultiHandler.WithDisconnectGrace.
 //
-// It assumes that stats.Handler methods are never called concurrently.
+// It's invoked concurrently for different connections, but never for the same one;
+// connection traffic of concurrent calls is accumulated atomically.
+//
+// Client calls are linked to their connections in TagRPC, which allocates, unless it's combined
+// with call handlers (see Instrument); server calls are not affected.
+// See ConnTrafficHandler for limitations of linking client calls.
 type ConnStatsHandler func(*ConnStats)
 
-// TagConn implements grpc/stats.Handler interface and does nothing.
+// TagRPC links client RPC to its connection.
 func (h ConnStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
-	return ctx
+	return setCallConn(ctx)
 }
 
-// TagConn tracks server-side
+// HandleRPC tracks connection RPC stats.
 func (h ConnStatsHandler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
+	handleConnRPC(ctx, stat, connCallbacks{stats: h, conns: clientConns})
+}
+
+// TagConn attaches omgrpc-internal data to connection context.
+func (h ConnStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return tagConn(ctx, info)
+}
+
+// HandleConn processes the connection stats.
+func (h ConnStatsHandler) HandleConn(ctx context.Context, stat stats.ConnStats) {
+	handleConn(ctx, stat, connCallbacks{stats: h, conns: clientConns})
+}
+
+// ----------------------------------------------------------------------------
+
+// ConnTrafficHandler implements https://pkg.go.dev/google.golang.org/grpc/stats#Handler for RPC connection traffic.
+// It is invoked for every received/sent header, trailer and message of connection calls
+// with the number of bytes received/sent (on the wire) and connection stats, where only ID, IsClient, Status (Connected),
+// LocalAddr, RemoteAddr and BeginTime fields are populated.
+// ConnStats argument is reused (pooled), so pointer cannot be stored - copy instead.
+//
+// It's invoked concurrently for the same connection, by its concurrent calls.
+//
+// Client calls are linked to their connections the same way as for ConnStatsHandler: by local and remote addresses,
+// when call headers are sent, so calls on connections, that share the same addresses (for example, in-memory ones),
+// are not linked and their traffic (and calls) is not counted. Active client connections are looked up under a lock
+// once per call attempt; ConnStatsHandler and ConnTrafficHandler, used on their own, share a process-wide registry
+// of them, while each handler, returned by Instrument, keeps its own.
+type ConnTrafficHandler func(conn *ConnStats, bytesRecv, bytesSent int)
+
+// TagRPC links client RPC to its connection.
+func (h ConnTrafficHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return setCallConn(ctx)
+}
+
+// HandleRPC tracks connection RPC stats.
+func (h ConnTrafficHandler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
+	handleConnRPC(ctx, stat, connCallbacks{traffic: h, conns: clientConns})
+}
+
+// TagConn attaches omgrpc-internal data to connection context.
+func (h ConnTrafficHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return tagConn(ctx, info)
+}
+
+// HandleConn processes the connection stats.
+func (h ConnTrafficHandler) HandleConn(ctx context.Context, stat stats.ConnStats) {
+	handleConn(ctx, stat, connCallbacks{traffic: h, conns: clientConns})
+}
+
+// ----------------------------------------------------------------------------
+
+// connCallbacks holds connection-related handlers, any of them can be nil.
+type connCallbacks struct {
+	stats   ConnStatsHandler
+	traffic ConnTrafficHandler
+	conns   *connsByAddr // active client connections
+
+	disconnectGrace time.Duration // max client disconnect delay, waiting for calls in flight to end
+}
+
+func (cb *connCallbacks) isEmpty() bool {
+	return cb.stats == nil && cb.traffic == nil
+}
+
+func handleConnRPC(ctx context.Context, stat stats.RPCStats, cb connCallbacks) {
+	var (
+		conn    *connState
+		endCall bool // whether End decrements connection active calls
+	)
 	if stat.IsClient() {
-		return // ctx has tagged conn only server-side
+		link := getCallConn(ctx)
+		if link == nil {
+			return // not tagged
+		}
+		switch s := stat.(type) {
+		case *stats.OutHeader:
+			// client call is bound to connection only when headers are sent:
+			conn = cb.conns.Get(s.LocalAddr, s.RemoteAddr)
+			link.attach(conn, &cb)
+		case *stats.End:
+			endCall = link.end()
+			conn, _ = link.conn.Load().(*connState)
+		default:
+			conn, _ = link.conn.Load().(*connState)
+		}
+	} else {
+		conn = getConnState(ctx)
+		_, endCall = stat.(*stats.End)
+	}
+	if conn == nil {
+		return // connection is not known (yet)
 	}
-
-	conn := getConnStats(ctx)
 
 	switch s := stat.(type) {
 
+	case *stats.Begin:
+		atomic.StoreInt64(&conn.lastActivity, s.BeginTime.UnixNano())
+		if !s.Client {
+			atomic.AddInt64(&conn.calls, 1)
+			atomic.AddInt32(&conn.activeCalls, 1)
+		}
+
 	case *stats.InHeader:
-		conn.BytesRecv += s.WireLength
+		atomic.AddInt64(&conn.bytesRecv, int64(s.WireLength))
+		cb.reportTraffic(conn, s.WireLength, 0)
 
 	case *stats.InPayload:
-		conn.BytesRecv += s.WireLength
+		atomic.AddInt64(&conn.bytesRecv, int64(s.WireLength))
+		atomic.StoreInt64(&conn.lastActivity, s.RecvTime.UnixNano())
+		cb.reportTraffic(conn, s.WireLength, 0)
 
 	case *stats.InTrailer:
-		conn.BytesRecv += s.WireLength
+		atomic.AddInt64(&conn.bytesRecv, int64(s.WireLength))
+		cb.reportTraffic(conn, s.WireLength, 0)
 
 	// case *stats.OutHeader: // no WireLength in OutHeader and OutTrailer (at least as of grpc@1.40.0)
 	// case *stats.OutTrailer: // WireLength is deprecated here
 
 	case *stats.OutPayload:
-		conn.BytesSent += s.WireLength
+		atomic.AddInt64(&conn.bytesSent, int64(s.WireLength))
+		atomic.StoreInt64(&conn.lastActivity, s.SentTime.UnixNano())
+		cb.reportTraffic(conn, 0, s.WireLength)
+
+	case *stats.End:
+		atomic.StoreInt64(&conn.lastActivity, s.EndTime.UnixNano())
+		if s.Client { // server call errors are not caused by transport
+			if reason := classifyDisconnect(s.Error); reason != disconnectUnknown {
+				atomic.StoreInt32(&conn.disconnectHint, int32(reason))
+			}
+		}
+		if endCall {
+			conn.endCall(&cb)
+		}
 
 	}
 }
 
-// TagRPC attaches omgrpc-internal data to connection context.
-func (h ConnStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
-	conn := connStatsPool.Get().(*ConnStats)
-	conn.LocalAddr = info.LocalAddr
-	conn.RemoteAddr = info.RemoteAddr
-	return setConnStats(ctx, conn)
+func tagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	c := &connContext{Context: ctx}
+	c.state.id = atomic.AddUint64(&lastConnID, 1)
+	c.state.localAddr = info.LocalAddr
+	c.state.remoteAddr = info.RemoteAddr
+	return c
 }
 
-// TagRPC attaches omgrpc-internal data to connection context.
-func (h ConnStatsHandler) HandleConn(ctx context.Context, stat stats.ConnStats) {
-	conn := getConnStats(ctx)
+func handleConn(ctx context.Context, stat stats.ConnStats, cb connCallbacks) {
+	conn := getConnState(ctx)
 
 	switch s := stat.(type) {
 	case *stats.ConnBegin:
-		conn.Status = Connected
-		conn.IsClient = s.Client
-		h(conn)
+		conn.isClient = s.Client
+		conn.beginTime = time.Now()
+		if conn.isClient {
+			cb.conns.Add(conn)
+		}
+		cb.report(conn, Connected)
 
 	case *stats.ConnEnd:
-		conn.Status = Disconnected
-		h(conn)
-		*conn = ConnStats{}
-		connStatsPool.Put(conn)
+		conn.endTime = time.Now()
+		if !conn.isClient {
+			cb.reportDisconnect(conn)
+			return
+		}
+
+		// client calls, that were in flight, end after connection and tell disconnect reason,
+		// so, if grace period is set, disconnect is reported when the last of them ends, but no later
+		// than the grace period (calls end only when user reads them, which may never happen):
+		cb.conns.Remove(conn)
+		atomic.StoreInt32(&conn.ended, 1)
+		if cb.disconnectGrace <= 0 || atomic.LoadInt32(&conn.activeCalls) == 0 {
+			cb.reportDisconnect(conn)
+			return
+		}
+		time.AfterFunc(cb.disconnectGrace, func() {
+			cb.reportDisconnect(conn)
+		})
+	}
+}
+
+// endCall decrements the number of active calls and reports client connection disconnect,
+// if connection ended before its last call.
+func (conn *connState) endCall(cb *connCallbacks) {
+	if atomic.AddInt32(&conn.activeCalls, -1) == 0 && atomic.LoadInt32(&conn.ended) != 0 {
+		cb.reportDisconnect(conn)
+	}
+}
+
+// reportTraffic invokes the traffic handler, if any.
+func (cb *connCallbacks) reportTraffic(conn *connState, bytesRecv, bytesSent int) {
+	if cb.traffic == nil || (bytesRecv == 0 && bytesSent == 0) {
+		return
+	}
+
+	s := connStatsPool.Get().(*ConnStats)
+	conn.fill(s, Connected)
+	cb.traffic(s, bytesRecv, bytesSent)
+	*s = ConnStats{}
+	connStatsPool.Put(s)
+}
+
+// reportDisconnect invokes the handler for disconnected connection once.
+func (cb *connCallbacks) reportDisconnect(conn *connState) {
+	if atomic.CompareAndSwapInt32(&conn.reported, 0, 1) {
+		cb.report(conn, Disconnected)
+	}
+}
+
+// report invokes the handler, if any, with (pooled) connection stats.
+func (cb *connCallbacks) report(conn *connState, status ConnStatus) {
+	if cb.stats == nil {
+		return
+	}
+
+	s := connStatsPool.Get().(*ConnStats)
+	conn.fill(s, status)
+	cb.stats(s)
+	*s = ConnStats{}
+	connStatsPool.Put(s)
+}
+
+// fill populates connection stats.
+func (conn *connState) fill(s *ConnStats, status ConnStatus) {
+	s.ID = conn.id
+	s.IsClient = conn.isClient
+	s.Status = status
+	s.LocalAddr = conn.localAddr
+	s.RemoteAddr = conn.remoteAddr
+	s.BeginTime = conn.beginTime
+	s.live = conn
+	if status == Disconnected {
+		s.EndTime = conn.endTime
+		s.BytesRecv = int(atomic.LoadInt64(&conn.bytesRecv))
+		s.BytesSent = int(atomic.LoadInt64(&conn.bytesSent))
+		s.Calls = int(atomic.LoadInt64(&conn.calls))
+		if conn.isClient {
+			s.DisconnectReason = disconnectReason(atomic.LoadInt32(&conn.disconnectHint)).String()
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// clientConns holds active client connections of handlers, which are not combined by Instrument.
+var clientConns = newConnsByAddr()
+
+// connsByAddr holds active client connections by addresses.
+type connsByAddr struct {
+	conns map[connAddrs][]*connState
+	mu    sync.RWMutex
+}
+
+// connAddrs identifies connection by local and remote addresses;
+// grpc reuses the same net.Addr values for connection and its RPC stats, so they are compared by identity where possible.
+type connAddrs struct {
+	local, remote interface{}
+}
+
+func newConnAddrs(local, remote net.Addr) connAddrs {
+	return connAddrs{local: addrKey(local), remote: addrKey(remote)}
+}
+
+func addrKey(addr net.Addr) interface{} {
+	if addr == nil || reflect.TypeOf(addr).Comparable() {
+		return addr
+	}
+	return addr.String()
+}
+
+func newConnsByAddr() *connsByAddr {
+	return &connsByAddr{conns: make(map[connAddrs][]*connState)}
+}
+
+func (r *connsByAddr) Add(conn *connState) {
+	key := newConnAddrs(conn.localAddr, conn.remoteAddr)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.conns[key] = append(r.conns[key], conn)
+}
+
+func (r *connsByAddr) Remove(conn *connState) {
+	key := newConnAddrs(conn.localAddr, conn.remoteAddr)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conns := r.conns[key]
+	for i, c := range conns {
+		if c == conn {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(r.conns, key)
+	} else {
+		r.conns[key] = conns
+	}
+}
+
+// Get returns connection with given addresses, if it's the only one.
+// Addresses may be ambiguous (for example, for in-memory connections, or when the same local address is reused),
+// and then the call is not linked to any connection rather than to a wrong one.
+func (r *connsByAddr) Get(local, remote net.Addr) *connState {
+	key := newConnAddrs(local, remote)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if conns := r.conns[key]; len(conns) == 1 {
+		return conns[0]
 	}
+	return nil
 }
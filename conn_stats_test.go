@@ -2,9 +2,17 @@ package omgrpc_test
 
 import (
 	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/bsm/omgrpc/internal/testpb"
+	"golang.org/x/net/http2"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
 
 	. "github.com/bsm/omgrpc"
 
@@ -17,6 +25,7 @@ var _ = Describe("ConnStatsHandler", func() {
 		ctx = context.Background()
 
 		subject         ConnStatsHandler
+		mu              sync.Mutex // client and server submit stats concurrently
 		clientConnStats []ConnStats
 		serverConnStats []ConnStats
 		client          testpb.TestClient
@@ -29,6 +38,9 @@ var _ = Describe("ConnStatsHandler", func() {
 		serverConnStats = serverConnStats[:0]
 
 		subject = ConnStatsHandler(func(conn *ConnStats) {
+			mu.Lock()
+			defer mu.Unlock()
+
 			if conn.IsClient {
 				clientConnStats = append(clientConnStats, *conn)
 			} else {
@@ -59,6 +71,9 @@ var _ = Describe("ConnStatsHandler", func() {
 
 		clientClose() // and disconnect right away
 
+		mu.Lock()
+		defer mu.Unlock()
+
 		Expect(clientConnStats).To(HaveLen(2))
 		Expect(serverConnStats).To(HaveLen(2))
 
@@ -68,26 +83,31 @@ var _ = Describe("ConnStatsHandler", func() {
 		s = clientConnStats[0]
 		Expect(s.IsClient).To(BeTrue())
 		Expect(s.Status).To(Equal(Connected))
-		Expect(s.BytesRecv).To(BeZero()) // supported only server-side
-		Expect(s.BytesSent).To(BeZero()) // supported only server-side
+		Expect(s.BytesRecv).To(BeZero()) // populated on disconnect
+		Expect(s.BytesSent).To(BeZero()) // populated on disconnect
+
+		Expect(s.Calls).To(BeZero())
 
 		// assert once that these fields are populated:
 		Expect(s.LocalAddr).NotTo(BeNil())
 		Expect(s.RemoteAddr).NotTo(BeNil())
+		Expect(s.BeginTime).To(BeTemporally("~", time.Now(), time.Second))
+		Expect(s.EndTime).To(BeZero())
 
 		// Client disconnect:
 		s = clientConnStats[1]
 		Expect(s.IsClient).To(BeTrue())
 		Expect(s.Status).To(Equal(Disconnected))
-		Expect(s.BytesRecv).To(BeZero()) // supported only server-side
-		Expect(s.BytesSent).To(BeZero()) // supported only server-side
+		Expect(s.BytesRecv).To(Equal(72))
+		Expect(s.BytesSent).To(Equal(16))
+		Expect(s.Calls).To(Equal(2))
 
 		// Server connect:
 		s = serverConnStats[0]
 		Expect(s.IsClient).To(BeFalse())
 		Expect(s.Status).To(Equal(Connected))
-		Expect(s.BytesRecv).To(BeZero()) // obviously, basically just checking that it's cleaned on pooling
-		Expect(s.BytesSent).To(BeZero()) // obviously, basically just checking that it's cleaned on pooling
+		Expect(s.BytesRecv).To(BeZero()) // populated only when disconnected
+		Expect(s.BytesSent).To(BeZero()) // populated only when disconnected
 
 		// Server disconnect:
 		s = serverConnStats[1]
@@ -95,5 +115,143 @@ var _ = Describe("ConnStatsHandler", func() {
 		Expect(s.Status).To(Equal(Disconnected))
 		Expect(s.BytesRecv).To(Equal(109))
 		Expect(s.BytesSent).To(Equal(30))
+		Expect(s.Calls).To(Equal(2))
+		Expect(s.EndTime).To(BeTemporally("~", time.Now(), time.Second))
+		Expect(s.Duration()).To(BeNumerically(">", 0))
+	})
+
+	It("accumulates traffic of concurrent streams", func() {
+		const streams, msgs = 8, 100
+		runConcurrentStreams(ctx, client, streams, msgs)
+		clientClose()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		Expect(clientConnStats).To(HaveLen(2))
+		Expect(serverConnStats).To(HaveLen(2))
+
+		// received bytes include headers and trailers:
+		s := clientConnStats[1]
+		Expect(s.Calls).To(Equal(streams))
+		Expect(s.BytesSent).To(Equal(8 * msgs * streams))
+		Expect(s.BytesRecv).To(BeNumerically(">", 16*msgs*streams))
+
+		s = serverConnStats[1]
+		Expect(s.Calls).To(Equal(streams))
+		Expect(s.BytesSent).To(Equal(16 * msgs * streams))
+		Expect(s.BytesRecv).To(BeNumerically(">", 8*msgs*streams))
+	})
+
+	It("does not link client calls to ambiguous connections", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		// in-memory connections have the same addresses:
+		other, otherClose, otherTeardown := initClientServerSystem(
+			[]grpc.DialOption{grpc.WithStatsHandler(subject)},
+			[]grpc.ServerOption{grpc.StatsHandler(subject)},
+		)
+		defer otherTeardown()
+
+		_, err = other.Unary(ctx, &testpb.Message{Payload: "2"})
+		Expect(err).NotTo(HaveOccurred())
+		otherClose()
+		clientClose()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		var clientCalls, serverCalls int
+		for _, s := range clientConnStats {
+			clientCalls += s.Calls
+		}
+		for _, s := range serverConnStats {
+			serverCalls += s.Calls
+		}
+		Expect(clientCalls).To(Equal(1))
+		Expect(serverCalls).To(Equal(2))
+	})
+
+	It("does not tag server calls", func() {
+		addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4567}
+		connCtx := subject.TagConn(ctx, &stats.ConnTagInfo{LocalAddr: addr, RemoteAddr: addr})
+		subject.HandleConn(connCtx, &stats.ConnBegin{})
+
+		callCtx := subject.TagRPC(connCtx, &stats.RPCTagInfo{FullMethodName: unaryMethod})
+		Expect(callCtx).To(BeIdenticalTo(connCtx))
+		Expect(subject.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: unaryMethod})).NotTo(BeIdenticalTo(ctx))
+	})
+
+	It("tracks transparently retried calls once", func() {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer lis.Close()
+		go serveRefusedStreams(lis)
+
+		cc, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), grpc.WithStatsHandler(subject))
+		Expect(err).NotTo(HaveOccurred())
+		defer cc.Close()
+
+		// the first attempt is refused and retried transparently, the second one fails:
+		_, err = testpb.NewTestClient(cc).Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(status.Code(err)).To(Equal(codes.Unavailable))
+		Expect(cc.Close()).To(Succeed())
+
+		Eventually(func() []ConnStatus {
+			mu.Lock()
+			defer mu.Unlock()
+
+			var statuses []ConnStatus
+			for _, s := range clientConnStats {
+				if s.RemoteAddr.String() == lis.Addr().String() {
+					statuses = append(statuses, s.Status)
+				}
+			}
+			return statuses
+		}).Should(Equal([]ConnStatus{Connected, Disconnected}))
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		s := clientConnStats[len(clientConnStats)-1]
+		Expect(s.Calls).To(Equal(1))
 	})
 })
+
+// serveRefusedStreams accepts HTTP/2 connections and refuses all their streams,
+// so that grpc clients retry calls transparently.
+func serveRefusedStreams(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			if _, err := io.ReadFull(conn, make([]byte, len(http2.ClientPreface))); err != nil {
+				return
+			}
+			framer := http2.NewFramer(conn, conn)
+			if err := framer.WriteSettings(); err != nil {
+				return
+			}
+			for {
+				frame, err := framer.ReadFrame()
+				if err != nil {
+					return
+				}
+				switch f := frame.(type) {
+				case *http2.SettingsFrame:
+					if !f.IsAck() {
+						_ = framer.WriteSettingsAck()
+					}
+				case *http2.HeadersFrame:
+					_ = framer.WriteRSTStream(f.StreamID, http2.ErrCodeRefusedStream)
+				}
+			}
+		}()
+	}
+}
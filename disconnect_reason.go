@@ -0,0 +1,70 @@
+package omgrpc
+
+// Disconnect reasons of client connections, populated for "reason" connection label (see ConnStats.DisconnectReason).
+//
+// grpc does not report why connection ends, so reason is derived from errors of client calls,
+// which were in flight on the connection, and only some reasons can be detected:
+//   - server connections have no reason (it's empty), as server transport does not report errors;
+//   - reason is "unknown" for client connections, that were idle or whose calls completed before disconnect,
+//     and for calls, that end after disconnect is reported (see MultiHandler.WithDisconnectGrace);
+//   - grpc servers send the same GOAWAY (NO_ERROR, without debug data) on GracefulStop, MaxConnectionAge
+//     and MaxConnectionIdle, so they are all reported as "goaway"; GracefulStop waits for calls to complete,
+//     so it's mostly "unknown";
+//   - server Stop closes connection without GOAWAY, so it looks like a broken connection ("transport_error");
+//   - connections, that failed during TLS handshake, are never reported, as handshake happens before
+//     stats handler is invoked;
+//   - grpc converts transport errors into Unavailable statuses, so they are recognized by messages,
+//     which are verified for grpc 1.40 only; with other grpc versions all the reasons, except "client_close",
+//     are reported as "unknown".
+const (
+	DisconnectReasonUnknown        = "unknown"         // reason was not detected
+	DisconnectReasonClientClose    = "client_close"    // client closed the connection (grpc.ClientConn.Close)
+	DisconnectReasonGoAway         = "goaway"          // server sent GOAWAY: GracefulStop, MaxConnectionAge or MaxConnectionIdle
+	DisconnectReasonTooManyPings   = "too_many_pings"  // server sent GOAWAY, enforcing keepalive policy
+	DisconnectReasonTransportError = "transport_error" // connection was broken: server Stop, read error, keepalive timeout etc
+)
+
+// ----------------------------------------------------------------------------
+
+// disconnectReason is an internal disconnect reason code, which can be stored atomically.
+type disconnectReason int32
+
+const (
+	disconnectUnknown disconnectReason = iota
+	disconnectClientClose
+	disconnectGoAway
+	disconnectTooManyPings
+	disconnectTransportError
+)
+
+func (r disconnectReason) String() string {
+	switch r {
+	case disconnectClientClose:
+		return DisconnectReasonClientClose
+	case disconnectGoAway:
+		return DisconnectReasonGoAway
+	case disconnectTooManyPings:
+		return DisconnectReasonTooManyPings
+	case disconnectTransportError:
+		return DisconnectReasonTransportError
+	default:
+		return DisconnectReasonUnknown
+	}
+}
+
+// classifyDisconnect returns disconnect reason, if client call error is caused by connection closing, or disconnectUnknown.
+func classifyDisconnect(err error) disconnectReason {
+	switch classifyTransportError(err) {
+	case transportErrorClientClose:
+		return disconnectClientClose
+	case transportErrorGoAway:
+		return disconnectGoAway
+	case transportErrorTooManyPings:
+		return disconnectTooManyPings
+	case transportErrorBroken:
+		return disconnectTransportError
+	default:
+		// transport.ErrConnClosing is reported whatever closed the connection:
+		return disconnectUnknown
+	}
+}
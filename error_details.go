@@ -0,0 +1,64 @@
+package omgrpc
+
+import (
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+)
+
+// WithErrorReasons limits "error_reason" label values (google.rpc.ErrorInfo reasons) to the allowed list,
+// other reasons are populated as LabelValueOther.
+// Calls without ErrorInfo status detail have "error_reason" label empty.
+//
+// If not set, all the reasons are populated as LabelValueOther (see label cardinality in package docs).
+func WithErrorReasons(allowed ...string) Option {
+	extract := buildErrorInfoExtractor(getErrorReason, allowed)
+	return func(o *options) {
+		o.setBuiltinLabel("error_reason", extract)
+	}
+}
+
+// WithErrorDomains limits "error_domain" label values (google.rpc.ErrorInfo domains) to the allowed list,
+// other domains are populated as LabelValueOther.
+// Calls without ErrorInfo status detail have "error_domain" label empty.
+//
+// If not set, all the domains are populated as LabelValueOther, the same as reasons (see WithErrorReasons).
+func WithErrorDomains(allowed ...string) Option {
+	extract := buildErrorInfoExtractor(getErrorDomain, allowed)
+	return func(o *options) {
+		o.setBuiltinLabel("error_domain", extract)
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// default "error_reason" and "error_domain" extractors, which allow no values:
+var (
+	extractCallErrorReason = buildErrorInfoExtractor(getErrorReason, nil)
+	extractCallErrorDomain = buildErrorInfoExtractor(getErrorDomain, nil)
+)
+
+func buildErrorInfoExtractor(get func(*errdetails.ErrorInfo) string, allowed []string) LabelExtractor {
+	allowedValues := make(map[string]bool, len(allowed))
+	for _, v := range allowed {
+		allowedValues[v] = true
+	}
+
+	return func(call *CallStats) string {
+		info := call.ErrorInfo()
+		if info == nil {
+			return ""
+		}
+
+		if v := get(info); allowedValues[v] {
+			return v
+		}
+		return LabelValueOther
+	}
+}
+
+func getErrorReason(info *errdetails.ErrorInfo) string {
+	return info.GetReason()
+}
+
+func getErrorDomain(info *errdetails.ErrorInfo) string {
+	return info.GetDomain()
+}
@@ -0,0 +1,125 @@
+package omgrpc_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+func errorWithDetails() error {
+	st, err := status.New(codes.ResourceExhausted, "quota exceeded").WithDetails(
+		&errdetails.ErrorInfo{Reason: "RATE_LIMITED", Domain: "example.com"},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(2 * time.Second)},
+	)
+	Expect(err).NotTo(HaveOccurred())
+	return st.Err()
+}
+
+var _ = Describe("CallStats", func() {
+	It("decodes status details", func() {
+		s := CallStats{Error: errorWithDetails()}
+		Expect(s.ErrorInfo()).NotTo(BeNil())
+		Expect(s.ErrorInfo().Reason).To(Equal("RATE_LIMITED"))
+		Expect(s.ErrorInfo().Domain).To(Equal("example.com"))
+
+		delay, ok := s.RetryDelay()
+		Expect(ok).To(BeTrue())
+		Expect(delay).To(Equal(2 * time.Second))
+	})
+
+	It("handles errors without details", func() {
+		for _, err := range []error{nil, errors.New("plain"), status.Error(codes.NotFound, "not found")} {
+			s := CallStats{Error: err}
+			Expect(s.ErrorInfo()).To(BeNil())
+
+			_, ok := s.RetryDelay()
+			Expect(ok).To(BeFalse())
+		}
+	})
+})
+
+var _ = Describe("Error details instruments", func() {
+	var (
+		ctx = context.Background()
+
+		calls        openmetrics.CounterFamily
+		allowedCalls openmetrics.CounterFamily
+		retryDelay   openmetrics.HistogramFamily
+		client       testpb.TestClient
+		clientClose  func()
+		teardown     func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		calls = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"side", "error_reason", "error_domain"},
+		})
+		allowedCalls = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_allowed_calls",
+			Labels: []string{"error_reason", "error_domain"},
+		})
+		retryDelay = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_retry_delay",
+			Unit:   "seconds",
+			Labels: []string{"side", "error_reason"},
+		}, []float64{1, 5})
+
+		handler := Instrument(
+			InstrumentCallCount(calls),
+			InstrumentCallCount(allowedCalls, WithErrorReasons("QUOTA_EXCEEDED"), WithErrorDomains("example.com")),
+			InstrumentRetryDelay(retryDelay, WithErrorReasons("RATE_LIMITED")),
+		)
+
+		client, clientClose, teardown = initClientServerSystemWith(
+			&testpb.TestServerImpl{UnaryError: errorWithDetails()},
+			[]grpc.DialOption{grpc.WithStatsHandler(handler)},
+			[]grpc.ServerOption{grpc.StatsHandler(handler)},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("populates error labels and observes retry delay", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+
+		stream, err := client.Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.CloseSend()).To(Succeed())
+		_, err = stream.Recv()
+		Expect(err).To(Equal(io.EOF))
+		clientClose()
+
+		Expect(calls.NumMetrics()).To(Equal(4))
+		Expect(calls.With("client", "other", "other").Total()).To(Equal(1.0))
+		Expect(calls.With("server", "other", "other").Total()).To(Equal(1.0))
+		Expect(calls.With("client", "", "").Total()).To(Equal(1.0))
+		Expect(calls.With("server", "", "").Total()).To(Equal(1.0))
+
+		Expect(allowedCalls.NumMetrics()).To(Equal(2))
+		Expect(allowedCalls.With("other", "example.com").Total()).To(Equal(2.0))
+		Expect(allowedCalls.With("", "").Total()).To(Equal(2.0))
+
+		Expect(retryDelay.NumMetrics()).To(Equal(2))
+		Expect(retryDelay.With("client", "RATE_LIMITED").Sum()).To(Equal(2.0))
+		Expect(retryDelay.With("server", "RATE_LIMITED").Sum()).To(Equal(2.0))
+	})
+})
@@ -0,0 +1,123 @@
+package omgrpc
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/stats"
+)
+
+// MethodMatcher matches full method names like "/com.package.Service/MethodName".
+type MethodMatcher func(fullMethodName string) bool
+
+// MatchMethod matches exact full method name like "/grpc.health.v1.Health/Check".
+func MatchMethod(fullMethodName string) MethodMatcher {
+	return func(name string) bool {
+		return name == fullMethodName
+	}
+}
+
+// MatchServicePrefix matches methods of services with the name prefix like "grpc.health.v1.Health" or "grpc.reflection.".
+func MatchServicePrefix(prefix string) MethodMatcher {
+	return func(name string) bool {
+		service, _ := splitFullMethodName(name)
+		return strings.HasPrefix(service, prefix)
+	}
+}
+
+// MatchMethodGlob matches full method names with shell pattern like "/grpc.health.*/*" (see path.Match for syntax).
+func MatchMethodGlob(pattern string) MethodMatcher {
+	return func(name string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+}
+
+// MatchMethodRegexp matches full method names with regular expression.
+func MatchMethodRegexp(re *regexp.Regexp) MethodMatcher {
+	return re.MatchString
+}
+
+// WithAllowedMethods makes call instruments to track only calls to methods matching any of matchers.
+//
+// Method filters are evaluated when RPC is tagged, so calls, that are filtered out
+// by all the handlers combined with Instrument, are not tracked at all.
+func WithAllowedMethods(matchers ...MethodMatcher) Option {
+	return func(o *options) {
+		o.callFilter().allow = append(o.callFilter().allow, matchers...)
+	}
+}
+
+// WithDeniedMethods makes call instruments to skip calls to methods matching any of matchers,
+// for example, health checks:
+//
+//	omgrpc.WithDeniedMethods(omgrpc.MatchServicePrefix("grpc.health."))
+func WithDeniedMethods(matchers ...MethodMatcher) Option {
+	return func(o *options) {
+		o.callFilter().deny = append(o.callFilter().deny, matchers...)
+	}
+}
+
+// WithClientOnly makes call instruments to track only client-side calls.
+// It's useful for handlers, shared by client and server.
+//
+// Unlike method filters, side filters are evaluated when call begins, as call side is not known when RPC is tagged,
+// so stats of server calls are still collected till then.
+func WithClientOnly() Option {
+	return func(o *options) {
+		o.callFilter().server = false
+	}
+}
+
+// WithServerOnly makes call instruments to track only server-side calls.
+// It's useful for handlers, shared by client and server.
+//
+// Side filters are evaluated when call begins (see WithClientOnly), except for client calls
+// without grpc.WaitForReady option (default), which are known to be client ones, and are filtered out when RPC is tagged.
+func WithServerOnly() Option {
+	return func(o *options) {
+		o.callFilter().client = false
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+type callFilter struct {
+	allow, deny    []MethodMatcher
+	client, server bool
+}
+
+// MatchMethod reports whether calls to the method should be tracked.
+func (f *callFilter) MatchMethod(fullMethodName string) bool {
+	if len(f.allow) != 0 && !matchAny(f.allow, fullMethodName) {
+		return false
+	}
+	return !matchAny(f.deny, fullMethodName)
+}
+
+// MatchTag reports whether the tagged call should be tracked, as far as it's known when RPC is tagged:
+// server calls are never fail-fast, so fail-fast calls are known to be client ones.
+func (f *callFilter) MatchTag(info *stats.RPCTagInfo) bool {
+	if info.FailFast && !f.client {
+		return false
+	}
+	return f.MatchMethod(info.FullMethodName)
+}
+
+// MatchSide reports whether calls of the side should be tracked.
+func (f *callFilter) MatchSide(isClient bool) bool {
+	if isClient {
+		return f.client
+	}
+	return f.server
+}
+
+func matchAny(matchers []MethodMatcher, fullMethodName string) bool {
+	for _, match := range matchers {
+		if match(fullMethodName) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package omgrpc_test
+
+import (
+	"context"
+	"io"
+	"regexp"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("Filters", func() {
+	var (
+		ctx = context.Background()
+
+		allCalls    openmetrics.CounterFamily
+		unaryCalls  openmetrics.CounterFamily
+		serverCalls openmetrics.CounterFamily
+		streamCalls openmetrics.CounterFamily
+		client      testpb.TestClient
+		clientClose func()
+		teardown    func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		desc := openmetrics.Desc{Labels: []string{"method", "side"}}
+
+		desc.Name = "grpc_all_calls"
+		allCalls = reg.Counter(desc)
+		desc.Name = "grpc_unary_calls"
+		unaryCalls = reg.Counter(desc)
+		desc.Name = "grpc_server_calls"
+		serverCalls = reg.Counter(desc)
+		desc.Name = "grpc_stream_calls"
+		streamCalls = reg.Counter(desc)
+
+		subject := Instrument(
+			InstrumentCallCount(allCalls),
+			InstrumentCallCount(unaryCalls, WithAllowedMethods(MatchMethodGlob("/*/Unary"))),
+			InstrumentCallCount(serverCalls, WithServerOnly(), WithDeniedMethods(MatchMethod(streamMethod))),
+			InstrumentCallCount(streamCalls,
+				WithAllowedMethods(MatchServicePrefix("com.blacksquaremedia."), MatchMethodRegexp(regexp.MustCompile(`Stream$`))),
+				WithDeniedMethods(MatchMethod(unaryMethod)),
+				WithClientOnly(),
+			),
+		)
+		client, clientClose, teardown = initClientServerSystem(
+			[]grpc.DialOption{
+				grpc.WithStatsHandler(subject),
+			},
+			[]grpc.ServerOption{
+				grpc.StatsHandler(subject),
+			},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("filters calls", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		stream, err := client.Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.CloseSend()).To(Succeed())
+		_, err = stream.Recv()
+		Expect(err).To(Equal(io.EOF))
+		clientClose()
+
+		Expect(allCalls.NumMetrics()).To(Equal(4))
+
+		Expect(unaryCalls.NumMetrics()).To(Equal(2))
+		Expect(unaryCalls.With(unaryMethod, "client").Total()).To(Equal(1.0))
+		Expect(unaryCalls.With(unaryMethod, "server").Total()).To(Equal(1.0))
+
+		Expect(serverCalls.NumMetrics()).To(Equal(1))
+		Expect(serverCalls.With(unaryMethod, "server").Total()).To(Equal(1.0))
+
+		Expect(streamCalls.NumMetrics()).To(Equal(1))
+		Expect(streamCalls.With(streamMethod, "client").Total()).To(Equal(1.0))
+	})
+
+	It("filters client calls by side, whether they are fail-fast or not", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.Unary(ctx, &testpb.Message{Payload: "2"}, grpc.WaitForReady(true))
+		Expect(err).NotTo(HaveOccurred())
+		clientClose()
+
+		Expect(allCalls.With(unaryMethod, "client").Total()).To(Equal(2.0))
+		Expect(serverCalls.NumMetrics()).To(Equal(1))
+		Expect(serverCalls.With(unaryMethod, "server").Total()).To(Equal(2.0))
+	})
+})
@@ -5,7 +5,9 @@ go 1.16
 require (
 	github.com/bsm/ginkgo v1.16.4
 	github.com/bsm/gomega v1.14.0
-	github.com/bsm/openmetrics v0.2.0
+	github.com/bsm/openmetrics v0.3.1
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
 	google.golang.org/grpc v1.40.0
 	google.golang.org/protobuf v1.27.1
 )
@@ -1,7 +1,6 @@
 package omgrpc
 
 import (
-	"strings"
 	"time"
 
 	"github.com/bsm/openmetrics"
@@ -9,92 +8,399 @@ import (
 )
 
 // InstrumentCallCount returns default stats.Handler to instrument RPC call count.
-// It populates labels it can recognize and leaves others empty:
-//
-//   - "method" - full method name like "/com.package/MethodName"
-//   - "status" or "code" - populated with gRPC code string: https://pkg.go.dev/google.golang.org/grpc/codes#Code
-//
-func InstrumentCallCount(m openmetrics.CounterFamily) stats.Handler {
-	extractors := buildCallExtractors(m.Desc().Labels)
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentCallCount(m openmetrics.CounterFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newCallLabeler(desc, o)
+	series := newCounterSeries(m, o)
 
-	return CallStatsHandler(func(call *CallStats) {
-		labels := extractCallLabels(extractors, call)
-		m.With(labels...).Add(1)
-	})
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		series.Get(labeler.Values(call)).Add(1)
+	}))
 }
 
 // InstrumentCallDuration returns default stats.Handler to instrument RPC call duration in units configured for metric.
-// It populates labels it can recognize and leaves others empty:
-//
-//   - "method" - full method name like "/com.package/MethodName"
-//   - "status" or "code" - populated with gRPC code string: https://pkg.go.dev/google.golang.org/grpc/codes#Code
-//
-func InstrumentCallDuration(m openmetrics.HistogramFamily) stats.Handler {
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentCallDuration(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
 	desc := m.Desc()
-	extractors := buildCallExtractors(desc.Labels)
+	o := newCallOptions(desc, opts)
+	return newCallDurationHandler(desc, o, newHistogramSeries(m, o))
+}
+
+// InstrumentCallDurationSummary returns default stats.Handler to instrument RPC call duration in units configured for metric,
+// it's the same as InstrumentCallDuration, but for summary metric families.
+// Note, that openmetrics summaries export only "_sum" and "_count" series, but no quantiles,
+// so use InstrumentCallDuration to track call duration distribution.
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentCallDurationSummary(m openmetrics.SummaryFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	return newCallDurationHandler(desc, o, newSummarySeries(m, o))
+}
+
+// InstrumentCallPhaseDuration returns default stats.Handler to instrument RPC call phase durations
+// (see CallPhase* constants) in units configured for metric.
+// Metric family must have "phase" label, it panics otherwise. Phases, that did not happen, are not observed.
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentCallPhaseDuration(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newCallLabeler(desc, o)
+	series := newHistogramSeries(m, o)
+	phaseIndex := mustLabelIndex(desc, "phase")
 	convertDuration := makeDurationConverter(desc.Unit)
 
-	return CallStatsHandler(func(call *CallStats) {
-		labels := extractCallLabels(extractors, call)
-		m.With(labels...).Observe(convertDuration(call.Duration()))
-	})
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		values := labeler.Values(call)
+		for _, phase := range callPhases {
+			if d, ok := call.PhaseDuration(phase); ok {
+				values.Set(phaseIndex, phase)
+				series.Get(values).Observe(convertDuration(d))
+			}
+		}
+	}))
+}
+
+// InstrumentRetryDelay returns default stats.Handler to instrument retry delay, suggested by google.rpc.RetryInfo
+// status detail of failed RPC calls, in units configured for metric.
+// Calls without RetryInfo are not observed.
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentRetryDelay(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newCallLabeler(desc, o)
+	series := newHistogramSeries(m, o)
+	convertDuration := makeDurationConverter(desc.Unit)
+
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		delay, ok := call.RetryDelay()
+		if !ok {
+			return
+		}
+
+		series.Get(labeler.Values(call)).Observe(convertDuration(delay))
+	}))
+}
+
+// InstrumentDeadlineUtilization returns default stats.Handler to instrument fraction of RPC call deadline budget
+// (see CallStats.Budget), consumed by the call: values close to 1 mean that call ran close to its deadline.
+// Calls without deadline or with no budget left when call began (see InstrumentLowDeadlineBudget) are not observed.
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentDeadlineUtilization(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newCallLabeler(desc, o)
+	series := newHistogramSeries(m, o)
+
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		budget, ok := call.Budget()
+		if !ok || budget <= 0 {
+			return
+		}
+
+		series.Get(labeler.Values(call)).Observe(float64(call.Duration()) / float64(budget))
+	}))
+}
+
+// InstrumentLowDeadlineBudget returns default stats.Handler to count RPC calls, that had less than threshold
+// of deadline budget left when call began (see CallStats.Budget), including already exceeded deadlines.
+// Such calls on server side usually indicate deadline propagation issues across hops.
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentLowDeadlineBudget(m openmetrics.CounterFamily, threshold time.Duration, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newCallLabeler(desc, o)
+	series := newCounterSeries(m, o)
+
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		if budget, ok := call.Budget(); !ok || budget >= threshold {
+			return
+		}
+
+		series.Get(labeler.Values(call)).Add(1)
+	}))
+}
+
+// InstrumentCallBytesSent returns default stats.Handler to instrument RPC call request (client) or response (server)
+// size in units configured for metric: "bytes" (default), "kilobytes" or "megabytes".
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentCallBytesSent(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newCallLabeler(desc, o)
+	series := newHistogramSeries(m, o)
+	convertBytes := makeBytesConverter(desc.Unit)
+
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		series.Get(labeler.Values(call)).Observe(convertBytes(call.BytesSent))
+	}))
+}
+
+// InstrumentCallBytesReceived returns default stats.Handler to instrument RPC call response (client) or request (server)
+// size in units configured for metric: "bytes" (default), "kilobytes" or "megabytes".
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentCallBytesReceived(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newCallLabeler(desc, o)
+	series := newHistogramSeries(m, o)
+	convertBytes := makeBytesConverter(desc.Unit)
+
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		series.Get(labeler.Values(call)).Observe(convertBytes(call.BytesRecv))
+	}))
+}
+
+// InstrumentCompressionRatioSent returns default stats.Handler to instrument RPC call request (client) or response (server)
+// compression ratio: uncompressed length divided by wire length, so values below 1 mean that compression is not effective
+// (wire length includes gRPC message framing). Calls without sent messages are not observed.
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentCompressionRatioSent(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newCallLabeler(desc, o)
+	series := newHistogramSeries(m, o)
+
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		if call.BytesSent == 0 {
+			return
+		}
+		series.Get(labeler.Values(call)).Observe(float64(call.UncompressedBytesSent) / float64(call.BytesSent))
+	}))
+}
+
+// InstrumentCompressionRatioReceived returns default stats.Handler to instrument RPC call response (client) or request (server)
+// compression ratio: uncompressed length divided by wire length, so values below 1 mean that compression is not effective
+// (wire length includes gRPC message framing). Calls without received messages are not observed.
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentCompressionRatioReceived(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newCallLabeler(desc, o)
+	series := newHistogramSeries(m, o)
+
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		if call.BytesRecv == 0 {
+			return
+		}
+		series.Get(labeler.Values(call)).Observe(float64(call.UncompressedBytesRecv) / float64(call.BytesRecv))
+	}))
+}
+
+// InstrumentMessageBytesSent returns default stats.Handler to instrument size of every sent RPC message
+// in units configured for metric: "bytes" (default), "kilobytes" or "megabytes".
+// It populates call labels it can recognize (see package docs) and leaves others empty,
+// labels which are not known until call ends (like "status") are always empty.
+func InstrumentMessageBytesSent(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newInFlightCallLabeler(desc, o)
+	series := newHistogramSeries(m, o)
+	convertBytes := makeBytesConverter(desc.Unit)
+
+	return o.filterCalls(MessageStatsHandler(func(call *CallStats, msg *MessageStats) {
+		if msg.IsRecv {
+			return
+		}
+		series.Get(labeler.Values(call)).Observe(convertBytes(msg.WireLength))
+	}))
+}
+
+// InstrumentMessageBytesReceived returns default stats.Handler to instrument size of every received RPC message
+// in units configured for metric: "bytes" (default), "kilobytes" or "megabytes".
+// It populates call labels it can recognize (see package docs) and leaves others empty,
+// labels which are not known until call ends (like "status") are always empty.
+func InstrumentMessageBytesReceived(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newInFlightCallLabeler(desc, o)
+	series := newHistogramSeries(m, o)
+	convertBytes := makeBytesConverter(desc.Unit)
+
+	return o.filterCalls(MessageStatsHandler(func(call *CallStats, msg *MessageStats) {
+		if !msg.IsRecv {
+			return
+		}
+		series.Get(labeler.Values(call)).Observe(convertBytes(msg.WireLength))
+	}))
+}
+
+// InstrumentMessagesSent returns default stats.Handler to instrument number of sent RPC stream messages.
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentMessagesSent(m openmetrics.CounterFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newCallLabeler(desc, o)
+	series := newCounterSeries(m, o)
+
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		series.Get(labeler.Values(call)).Add(float64(call.MsgsSent))
+	}))
+}
+
+// InstrumentMessagesReceived returns default stats.Handler to instrument number of received RPC stream messages.
+// It populates call labels it can recognize (see package docs) and leaves others empty.
+func InstrumentMessagesReceived(m openmetrics.CounterFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newCallLabeler(desc, o)
+	series := newCounterSeries(m, o)
+
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		series.Get(labeler.Values(call)).Add(float64(call.MsgsRecv))
+	}))
 }
 
 // InstrumentActiveConns returns default stats.Handler to instrument number of active gRPC connections.
-// It populates no labels.
-func InstrumentActiveConns(m openmetrics.GaugeFamily) stats.Handler {
+// It populates connection labels it can recognize and leaves others empty:
+//
+//   - "side" or "role" - "client" or "server"
+//   - "peer" - remote host (without port)
+//   - "local_addr" - local address
+func InstrumentActiveConns(m openmetrics.GaugeFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newConnOptions(desc, opts)
+	labeler := newActiveConnLabeler(desc, o)
+	series := newGaugeSeries(m, o)
+
 	return ConnStatsHandler(func(conn *ConnStats) {
 		switch conn.Status {
 		case Connected:
-			m.With().Add(1)
+			series.Get(labeler.Values(conn)).Add(1)
 		case Disconnected:
-			m.With().Add(-1)
+			series.Get(labeler.Values(conn)).Add(-1)
 		}
 	})
 }
 
-// ----------------------------------------------------------------------------
+// InstrumentConnOpened returns default stats.Handler to instrument number of opened gRPC connections.
+// It populates connection labels it can recognize (see InstrumentActiveConns) and leaves others empty.
+func InstrumentConnOpened(m openmetrics.CounterFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newConnOptions(desc, opts)
+	labeler := newConnLabeler(desc, o)
+	series := newCounterSeries(m, o)
 
-func buildCallExtractors(labels []string) []func(*CallStats) string {
-	if len(labels) == 0 {
-		return nil
-	}
+	return ConnStatsHandler(func(conn *ConnStats) {
+		if conn.Status != Connected {
+			return
+		}
+		series.Get(labeler.Values(conn)).Add(1)
+	})
+}
 
-	extractors := make([]func(*CallStats) string, 0, len(labels))
-	for _, l := range labels {
-		if strings.EqualFold(l, "method") {
-			extractors = append(extractors, extractCallMethod)
-		} else if strings.EqualFold(l, "status") || strings.EqualFold(l, "code") {
-			extractors = append(extractors, extractCallStatus)
-		} else {
-			extractors = append(extractors, returnEmptyString)
+// InstrumentConnClosed returns default stats.Handler to instrument number of closed gRPC connections.
+// It populates connection labels it can recognize (see InstrumentActiveConns) and leaves others empty,
+// "reason" label is populated with disconnect reason of client connections (see DisconnectReason* constants).
+func InstrumentConnClosed(m openmetrics.CounterFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newConnOptions(desc, opts)
+	labeler := newConnLabeler(desc, o)
+	series := newCounterSeries(m, o)
+
+	return ConnStatsHandler(func(conn *ConnStats) {
+		if conn.Status != Disconnected {
+			return
 		}
-	}
-	return extractors
+		series.Get(labeler.Values(conn)).Add(1)
+	})
 }
 
-func extractCallLabels(extractors []func(*CallStats) string, call *CallStats) []string {
-	if len(extractors) == 0 {
-		return nil
-	}
+// InstrumentConnBytes returns default stats.Handler to instrument gRPC connection traffic
+// in units configured for metric: "bytes" (default), "kilobytes" or "megabytes".
+// Metric family must have "direction" label ("sent" or "received"), it panics otherwise.
+// Traffic is added as it happens, so "reason" label is always empty.
+// Client calls are linked to their connections by local and remote addresses, so client-side traffic is not counted,
+// when several client connections in the process share them (like in-memory connections, such as bufconn).
+// It populates connection labels it can recognize (see InstrumentActiveConns) and leaves others empty.
+func InstrumentConnBytes(m openmetrics.CounterFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newConnOptions(desc, opts)
+	labeler := newConnLabeler(desc, o)
+	series := newCounterSeries(m, o)
+	directionIndex := mustLabelIndex(desc, "direction")
+	convertBytes := makeBytesConverter(desc.Unit)
 
-	values := make([]string, 0, len(extractors))
-	for _, extract := range extractors {
-		values = append(values, extract(call))
-	}
-	return values
+	return ConnTrafficHandler(func(conn *ConnStats, bytesRecv, bytesSent int) {
+		values := labeler.Values(conn)
+		if bytesSent != 0 {
+			values.Set(directionIndex, "sent")
+			series.Get(values).Add(convertBytes(bytesSent))
+		}
+		if bytesRecv != 0 {
+			values.Set(directionIndex, "received")
+			series.Get(values).Add(convertBytes(bytesRecv))
+		}
+	})
+}
+
+// InstrumentConnDuration returns default stats.Handler to instrument gRPC connection duration (age, when disconnected)
+// in units configured for metric.
+// It populates connection labels it can recognize (see InstrumentActiveConns) and leaves others empty.
+func InstrumentConnDuration(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newConnOptions(desc, opts)
+	labeler := newConnLabeler(desc, o)
+	series := newHistogramSeries(m, o)
+	convertDuration := makeDurationConverter(desc.Unit)
+
+	return ConnStatsHandler(func(conn *ConnStats) {
+		if conn.Status != Disconnected {
+			return
+		}
+		series.Get(labeler.Values(conn)).Observe(convertDuration(conn.Duration()))
+	})
 }
 
-func extractCallMethod(call *CallStats) string {
-	return call.FullMethodName
+// InstrumentCallsPerConn returns default stats.Handler to instrument number of RPC calls per gRPC connection
+// (observed, when disconnected).
+// Connections, that serve a single call each, usually indicate clients, which reconnect per request.
+// It populates connection labels it can recognize (see InstrumentActiveConns) and leaves others empty.
+func InstrumentCallsPerConn(m openmetrics.HistogramFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newConnOptions(desc, opts)
+	labeler := newConnLabeler(desc, o)
+	series := newHistogramSeries(m, o)
+
+	return ConnStatsHandler(func(conn *ConnStats) {
+		if conn.Status != Disconnected {
+			return
+		}
+		series.Get(labeler.Values(conn)).Observe(float64(conn.Calls))
+	})
 }
 
-func extractCallStatus(call *CallStats) string {
-	return call.Code().String()
+// InstrumentInFlightCalls returns default stats.Handler to instrument number of RPC calls currently in flight.
+// It populates call labels it can recognize (see package docs) and leaves others empty,
+// labels which are not known until call ends (like "status") are always empty.
+func InstrumentInFlightCalls(m openmetrics.GaugeFamily, opts ...Option) stats.Handler {
+	desc := m.Desc()
+	o := newCallOptions(desc, opts)
+	labeler := newInFlightCallLabeler(desc, o)
+	series := newGaugeSeries(m, o)
+
+	return o.filterCalls(Instrument(
+		CallBeginHandler(func(call *CallStats) {
+			series.Get(labeler.Values(call)).Add(1)
+		}),
+		CallStatsHandler(func(call *CallStats) {
+			series.Get(labeler.Values(call)).Add(-1)
+		}),
+	))
 }
 
-func returnEmptyString(*CallStats) string {
-	return ""
+// ----------------------------------------------------------------------------
+
+// newCallDurationHandler returns a handler, that observes RPC call duration in units configured for metric,
+// it's shared by histogram and summary call duration instruments.
+func newCallDurationHandler(desc *openmetrics.Desc, o *options, series observerSeries) stats.Handler {
+	labeler := newCallLabeler(desc, o)
+	convertDuration := makeDurationConverter(desc.Unit)
+
+	return o.filterCalls(CallStatsHandler(func(call *CallStats) {
+		series.Observer(labeler.Values(call)).Observe(convertDuration(call.Duration()))
+	}))
 }
 
 func makeDurationConverter(unit string) func(time.Duration) float64 {
@@ -109,3 +415,14 @@ func makeDurationConverter(unit string) func(time.Duration) float64 {
 		return func(d time.Duration) float64 { return d.Seconds() }
 	}
 }
+
+func makeBytesConverter(unit string) func(int) float64 {
+	switch unit {
+	case "kilobytes":
+		return func(n int) float64 { return float64(n) / 1e3 }
+	case "megabytes":
+		return func(n int) float64 { return float64(n) / 1e6 }
+	default:
+		return func(n int) float64 { return float64(n) }
+	}
+}
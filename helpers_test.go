@@ -0,0 +1,578 @@
+package omgrpc_test
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+const (
+	unaryMethod  = "/com.blacksquaremedia.omgrpc.internal.testpb.Test/Unary"
+	streamMethod = "/com.blacksquaremedia.omgrpc.internal.testpb.Test/Stream"
+)
+
+var _ = Describe("InstrumentCallCount", func() {
+	var (
+		ctx = context.Background()
+
+		callCount openmetrics.CounterFamily
+		client    testpb.TestClient
+		teardown  func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		callCount = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"service", "method_name", "type", "side", "fail_fast", "peer", "local_addr", "code", "unknown"},
+		})
+
+		subject := InstrumentCallCount(callCount)
+		client, _, teardown = initClientServerSystem(
+			[]grpc.DialOption{
+				grpc.WithStatsHandler(subject),
+			},
+			[]grpc.ServerOption{
+				grpc.StatsHandler(subject),
+			},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("populates built-in labels", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		stream, err := client.Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.CloseSend()).To(Succeed())
+		_, err = stream.Recv()
+		Expect(err).To(Equal(io.EOF))
+
+		const service = "com.blacksquaremedia.omgrpc.internal.testpb.Test"
+		Eventually(callCount.NumMetrics).Should(Equal(4))
+		Expect(callCount.With(service, "Unary", "unary", "client", "true", "bufconn", "bufconn", "OK", "").Total()).To(Equal(1.0))
+		Expect(callCount.With(service, "Unary", "unary", "server", "false", "bufconn", "bufconn", "OK", "").Total()).To(Equal(1.0))
+		Expect(callCount.With(service, "Stream", "bidi_stream", "client", "true", "bufconn", "bufconn", "OK", "").Total()).To(Equal(1.0))
+		Expect(callCount.With(service, "Stream", "bidi_stream", "server", "false", "bufconn", "bufconn", "OK", "").Total()).To(Equal(1.0))
+	})
+})
+
+var _ = Describe("InstrumentInFlightCalls", func() {
+	var (
+		ctx = context.Background()
+
+		inFlight openmetrics.GaugeFamily
+		client   testpb.TestClient
+		teardown func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		inFlight = reg.Gauge(openmetrics.Desc{
+			Name:   "grpc_in_flight_calls",
+			Labels: []string{"method", "status"},
+		})
+
+		subject := InstrumentInFlightCalls(inFlight)
+		client, _, teardown = initClientServerSystem(
+			[]grpc.DialOption{
+				grpc.WithStatsHandler(subject),
+			},
+			[]grpc.ServerOption{
+				grpc.StatsHandler(subject),
+			},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("tracks calls in flight", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() float64 {
+			return inFlight.With(unaryMethod, "").Value()
+		}).Should(Equal(0.0))
+
+		stream, err := client.Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.Send(&testpb.Message{Payload: "2"})).To(Succeed())
+		_, err = stream.Recv()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(inFlight.With(streamMethod, "").Value()).To(Equal(2.0)) // client + server
+
+		Expect(stream.CloseSend()).To(Succeed())
+		_, err = stream.Recv()
+		Expect(err).To(Equal(io.EOF))
+		Eventually(func() float64 {
+			return inFlight.With(streamMethod, "").Value()
+		}).Should(Equal(0.0))
+	})
+})
+
+var _ = Describe("InstrumentMessagesSent/InstrumentMessagesReceived", func() {
+	var (
+		ctx = context.Background()
+
+		msgsSent openmetrics.CounterFamily
+		msgsRecv openmetrics.CounterFamily
+		client   testpb.TestClient
+		teardown func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		msgsSent = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_msgs_sent",
+			Labels: []string{"method", "status"},
+		})
+		msgsRecv = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_msgs_received",
+			Labels: []string{"method", "status"},
+		})
+
+		client, _, teardown = initClientServerSystem(
+			[]grpc.DialOption{
+				grpc.WithStatsHandler(Instrument(
+					InstrumentMessagesSent(msgsSent),
+					InstrumentMessagesReceived(msgsRecv),
+				)),
+			},
+			nil,
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("counts stream messages", func() {
+		stream, err := client.Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		for _, payload := range []string{"1", "2", "3"} {
+			Expect(stream.Send(&testpb.Message{Payload: payload})).To(Succeed())
+		}
+		Expect(stream.CloseSend()).To(Succeed())
+
+		for i := 0; i < 3; i++ {
+			_, err = stream.Recv()
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err = stream.Recv()
+		Expect(err).To(Equal(io.EOF))
+
+		Expect(msgsSent.With(streamMethod, "OK").Total()).To(Equal(3.0))
+		Expect(msgsRecv.With(streamMethod, "OK").Total()).To(Equal(3.0))
+	})
+})
+
+var _ = Describe("InstrumentCallDuration/InstrumentCallDurationSummary", func() {
+	var (
+		ctx = context.Background()
+
+		histogram openmetrics.HistogramFamily
+		summary   openmetrics.SummaryFamily
+		client    testpb.TestClient
+		teardown  func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		histogram = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_call_duration",
+			Unit:   "seconds",
+			Labels: []string{"method", "status"},
+		}, []float64{.1, 1})
+		summary = reg.Summary(openmetrics.Desc{
+			Name:   "grpc_call_duration_summary",
+			Unit:   "milliseconds",
+			Labels: []string{"method", "status"},
+		})
+
+		client, _, teardown = initClientServerSystemWith(
+			&testpb.TestServerImpl{UnaryDelay: 20 * time.Millisecond},
+			[]grpc.DialOption{
+				grpc.WithStatsHandler(Instrument(
+					InstrumentCallDuration(histogram),
+					InstrumentCallDurationSummary(summary),
+				)),
+			},
+			nil,
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("observes call duration", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(histogram.With(unaryMethod, "OK").Count()).To(Equal(int64(1)))
+		Expect(histogram.With(unaryMethod, "OK").Sum()).To(BeNumerically(">=", 0.02))
+		Expect(summary.With(unaryMethod, "OK").Count()).To(Equal(int64(1)))
+		Expect(summary.With(unaryMethod, "OK").Sum()).To(BeNumerically(">=", 20))
+		Expect(summary.With(unaryMethod, "OK").Sum()).To(BeNumerically("~", histogram.With(unaryMethod, "OK").Sum()*1000, 1))
+	})
+})
+
+var _ = Describe("InstrumentCallBytes*/InstrumentMessageBytes*", func() {
+	var (
+		ctx = context.Background()
+
+		callBytesSent openmetrics.HistogramFamily
+		callBytesRecv openmetrics.HistogramFamily
+		msgBytesSent  openmetrics.HistogramFamily
+		msgBytesRecv  openmetrics.HistogramFamily
+		client        testpb.TestClient
+		teardown      func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		callBytesSent = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_call_sent",
+			Unit:   "bytes",
+			Labels: []string{"method", "status"},
+		}, []float64{10, 100})
+		callBytesRecv = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_call_received",
+			Unit:   "kilobytes",
+			Labels: []string{"method", "status"},
+		}, []float64{1, 10})
+		msgBytesSent = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_message_sent",
+			Unit:   "bytes",
+			Labels: []string{"method", "status"},
+		}, []float64{10, 100})
+		msgBytesRecv = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_message_received",
+			Unit:   "bytes",
+			Labels: []string{"method", "status"},
+		}, []float64{10, 100})
+
+		client, _, teardown = initClientServerSystem(
+			[]grpc.DialOption{
+				grpc.WithStatsHandler(Instrument(
+					InstrumentCallBytesSent(callBytesSent),
+					InstrumentCallBytesReceived(callBytesRecv),
+					InstrumentMessageBytesSent(msgBytesSent),
+					InstrumentMessageBytesReceived(msgBytesRecv),
+				)),
+			},
+			nil,
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("observes call sizes", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(callBytesSent.With(unaryMethod, "OK").Count()).To(Equal(int64(1)))
+		Expect(callBytesSent.With(unaryMethod, "OK").Sum()).To(Equal(8.0))
+		Expect(callBytesRecv.With(unaryMethod, "OK").Count()).To(Equal(int64(1)))
+		Expect(callBytesRecv.With(unaryMethod, "OK").Sum()).To(BeNumerically("~", 0.015, 1e-9))
+	})
+
+	It("observes message sizes", func() {
+		stream, err := client.Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.Send(&testpb.Message{Payload: "1"})).To(Succeed())
+		Expect(stream.Send(&testpb.Message{Payload: "2"})).To(Succeed())
+		Expect(stream.CloseSend()).To(Succeed())
+		for i := 0; i < 2; i++ {
+			_, err = stream.Recv()
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err = stream.Recv()
+		Expect(err).To(Equal(io.EOF))
+
+		Expect(msgBytesSent.With(streamMethod, "").Count()).To(Equal(int64(2)))
+		Expect(msgBytesSent.With(streamMethod, "").Sum()).To(Equal(16.0))
+		Expect(msgBytesRecv.With(streamMethod, "").Count()).To(Equal(int64(2)))
+		Expect(msgBytesRecv.With(streamMethod, "").Sum()).To(Equal(32.0))
+	})
+})
+
+var _ = Describe("InstrumentCompressionRatio*", func() {
+	var (
+		ctx = context.Background()
+
+		ratioSent   openmetrics.HistogramFamily
+		ratioRecv   openmetrics.HistogramFamily
+		client      testpb.TestClient
+		clientClose func()
+		teardown    func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		ratioSent = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_compression_ratio_sent",
+			Labels: []string{"side", "request_encoding", "response_encoding"},
+		}, []float64{1, 2})
+		ratioRecv = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_compression_ratio_received",
+			Labels: []string{"side", "request_encoding", "response_encoding"},
+		}, []float64{1, 2})
+
+		handler := Instrument(
+			InstrumentCompressionRatioSent(ratioSent),
+			InstrumentCompressionRatioReceived(ratioRecv),
+		)
+		client, clientClose, teardown = initClientServerSystem(
+			[]grpc.DialOption{grpc.WithStatsHandler(handler)},
+			[]grpc.ServerOption{grpc.StatsHandler(handler)},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("observes compression ratios", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.Unary(ctx, &testpb.Message{Payload: "1"}, grpc.UseCompressor(gzip.Name))
+		Expect(err).NotTo(HaveOccurred())
+		clientClose()
+
+		for _, m := range []openmetrics.HistogramFamily{ratioSent, ratioRecv} {
+			Expect(m.NumMetrics()).To(Equal(4))
+			for _, side := range []string{"client", "server"} {
+				Expect(m.With(side, "identity", "identity").Count()).To(Equal(int64(1)))
+				Expect(m.With(side, "gzip", "gzip").Count()).To(Equal(int64(1)))
+				Expect(m.With(side, "gzip", "gzip").Sum()).To(BeNumerically("<", 1)) // tiny messages are not worth compressing
+			}
+		}
+		Expect(ratioSent.With("client", "identity", "identity").Sum()).To(Equal(3.0 / 8))
+		Expect(ratioRecv.With("client", "identity", "identity").Sum()).To(Equal(10.0 / 15))
+	})
+
+	It("populates unknown received encodings as other", func() {
+		handler := InstrumentCompressionRatioReceived(ratioRecv)
+
+		call := newMockCall(unaryMethod) // server call
+		for _, compression := range []string{"gzip", "x-custom-1", "x-custom-2"} {
+			call.inHeader.Compression = compression
+			call.run(handler, 1)
+		}
+
+		Expect(ratioRecv.NumMetrics()).To(Equal(2))
+		Expect(ratioRecv.With("server", "gzip", "identity").Count()).To(Equal(int64(1)))
+		Expect(ratioRecv.With("server", "other", "identity").Count()).To(Equal(int64(2)))
+	})
+})
+
+var _ = Describe("InstrumentDeadlineUtilization/InstrumentLowDeadlineBudget", func() {
+	var (
+		ctx = context.Background()
+
+		utilization openmetrics.HistogramFamily
+		lowBudget   openmetrics.CounterFamily
+		client      testpb.TestClient
+		clientClose func()
+		teardown    func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		utilization = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_deadline_utilization",
+			Labels: []string{"side"},
+		}, []float64{.5, .9})
+		lowBudget = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_low_deadline_budget",
+			Labels: []string{"side"},
+		})
+
+		handler := Instrument(
+			InstrumentDeadlineUtilization(utilization),
+			InstrumentLowDeadlineBudget(lowBudget, 5*time.Second),
+		)
+		client, clientClose, teardown = initClientServerSystem(
+			[]grpc.DialOption{grpc.WithStatsHandler(handler)},
+			[]grpc.ServerOption{grpc.StatsHandler(handler)},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("tracks deadlines", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"}) // no deadline
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, timeout := range []time.Duration{time.Second, time.Minute} {
+			timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+			_, err = client.Unary(timeoutCtx, &testpb.Message{Payload: "1"})
+			cancel()
+			Expect(err).NotTo(HaveOccurred())
+		}
+		clientClose()
+
+		Expect(utilization.NumMetrics()).To(Equal(2))
+		for _, side := range []string{"client", "server"} {
+			Expect(utilization.With(side).Count()).To(Equal(int64(2)))
+			Expect(utilization.With(side).Sum()).To(BeNumerically("<", .1))
+		}
+
+		Expect(lowBudget.NumMetrics()).To(Equal(2))
+		Expect(lowBudget.With("client").Total()).To(Equal(1.0))
+		Expect(lowBudget.With("server").Total()).To(Equal(1.0))
+	})
+})
+
+var _ = Describe("InstrumentConnOpened/InstrumentConnClosed/InstrumentConnDuration/InstrumentCallsPerConn", func() {
+	var (
+		ctx = context.Background()
+
+		opened       openmetrics.CounterFamily
+		closed       openmetrics.CounterFamily
+		duration     openmetrics.HistogramFamily
+		callsPerConn openmetrics.HistogramFamily
+		client       testpb.TestClient
+		clientClose  func()
+		teardown     func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		opened = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_conn_opened",
+			Labels: []string{"side"},
+		})
+		closed = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_conn_closed",
+			Labels: []string{"side"},
+		})
+		duration = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_conn_duration",
+			Unit:   "seconds",
+			Labels: []string{"side"},
+		}, []float64{1, 60})
+		callsPerConn = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_calls_per_conn",
+			Labels: []string{"side"},
+		}, []float64{1, 10})
+
+		handler := Instrument(
+			InstrumentConnOpened(opened),
+			InstrumentConnClosed(closed),
+			InstrumentConnDuration(duration),
+			InstrumentCallsPerConn(callsPerConn),
+		)
+		client, clientClose, teardown = initClientServerSystem(
+			[]grpc.DialOption{grpc.WithStatsHandler(handler)},
+			[]grpc.ServerOption{grpc.StatsHandler(handler)},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("tracks connection lifetime", func() {
+		for i := 0; i < 3; i++ {
+			_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(opened.With("client").Total()).To(Equal(1.0))
+		Expect(opened.With("server").Total()).To(Equal(1.0))
+		Expect(closed.NumMetrics()).To(BeZero())
+
+		clientClose()
+
+		Expect(closed.With("client").Total()).To(Equal(1.0))
+		Expect(closed.With("server").Total()).To(Equal(1.0))
+		Expect(duration.With("client").Count()).To(Equal(int64(1)))
+		Expect(duration.With("server").Count()).To(Equal(int64(1)))
+		Expect(duration.With("server").Sum()).To(BeNumerically(">", 0))
+
+		Expect(callsPerConn.NumMetrics()).To(Equal(2))
+		Expect(callsPerConn.With("client").Sum()).To(Equal(3.0))
+		Expect(callsPerConn.With("server").Sum()).To(Equal(3.0))
+	})
+})
+
+var _ = Describe("InstrumentConnBytes", func() {
+	var (
+		ctx = context.Background()
+
+		connBytes   openmetrics.CounterFamily
+		client      testpb.TestClient
+		clientClose func()
+		teardown    func()
+	)
+
+	BeforeEach(func() {
+		connBytes = openmetrics.NewConsistentRegistry(mockTime).Counter(openmetrics.Desc{
+			Name:   "grpc_conn",
+			Unit:   "bytes",
+			Labels: []string{"side", "direction"},
+		})
+
+		handler := InstrumentConnBytes(connBytes)
+		client, clientClose, teardown = initClientServerSystem(
+			[]grpc.DialOption{grpc.WithStatsHandler(handler)},
+			[]grpc.ServerOption{grpc.StatsHandler(handler)},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("counts connection traffic", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+		clientClose()
+
+		Expect(connBytes.NumMetrics()).To(Equal(4))
+		Expect(connBytes.With("client", "sent").Total()).To(Equal(8.0))
+		Expect(connBytes.With("client", "received").Total()).To(BeNumerically(">", 15))
+		Expect(connBytes.With("server", "sent").Total()).To(Equal(15.0))
+		Expect(connBytes.With("server", "received").Total()).To(BeNumerically(">", 8))
+	})
+
+	It("counts traffic of open connections", func() {
+		teardown() // in-memory client connections can not be told apart, so keep only one
+
+		combined := Instrument(
+			InstrumentConnBytes(connBytes),
+			CallStatsHandler(func(*CallStats) {}),
+		)
+		client, _, teardown := initClientServerSystem(
+			[]grpc.DialOption{grpc.WithStatsHandler(combined)},
+			nil,
+		)
+		defer teardown()
+
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(connBytes.With("client", "sent").Total()).To(Equal(8.0))
+		Expect(connBytes.With("client", "received").Total()).To(BeNumerically(">", 15))
+	})
+})
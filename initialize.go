@@ -0,0 +1,182 @@
+package omgrpc
+
+import (
+	"fmt"
+
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// InitializeMetrics pre-creates zero-valued series for every method registered on the server,
+// so they are exported before the first call (which is needed for rate() and absence alerts):
+//
+//	omgrpc.InitializeMetrics(server,
+//	  callCount,
+//	  omgrpc.FamilyOptions(callDuration, omgrpc.WithStatusClasses(classes)),
+//	  omgrpc.InFlightFamilyOptions(inFlightCalls),
+//	  omgrpc.CallPhaseFamilyOptions(callPhaseDuration),
+//	)
+//
+// Metric families and their options are expected to be the ones passed to call Instrument* functions,
+// labels are populated in the same way (for server side), custom ones (see WithLabel) are populated
+// for a call without metadata, and methods, that are filtered out (see WithAllowedMethods), are skipped.
+//
+// Families are not told apart by their labels, so the caller tells, which instrument every family is passed to:
+// families of instruments, that observe ended calls (like InstrumentCallCount), are passed as is or with FamilyOptions,
+// families of in-flight instruments - with InFlightFamilyOptions and families of InstrumentCallPhaseDuration -
+// with CallPhaseFamilyOptions. It panics, when family type is not supported by its instruments
+// (for example, a gauge family is passed as is). Connection and watchdog families are not supported.
+//
+// Label limits (see WithLabelLimit) are applied to pre-created series, series limit (see WithSeriesLimit)
+// stops pre-creating them once reached, both are tracked separately from the instrument ones
+// and never invoke WithOnLimit callback.
+//
+// Labels "status" or "code" are populated with "OK" only,
+// use InitializeMetricsWithCodes to pre-create series for other codes as well.
+func InitializeMetrics(server *grpc.Server, families ...openmetrics.MetricFamily) {
+	InitializeMetricsWithCodes(server, []codes.Code{codes.OK}, families...)
+}
+
+// InitializeMetricsWithCodes is like InitializeMetrics, but pre-creates series for every given status code.
+// Codes are ignored for families that have no labels, derived from status.
+func InitializeMetricsWithCodes(server *grpc.Server, statusCodes []codes.Code, families ...openmetrics.MetricFamily) {
+	serviceInfo := server.GetServiceInfo()
+	for _, m := range families {
+		f, ok := m.(*familyOptions)
+		if !ok {
+			f = &familyOptions{MetricFamily: m}
+		}
+		initializeFamily(serviceInfo, statusCodes, f)
+	}
+}
+
+// FamilyOptions binds Instrument* function options to metric family, passed to InitializeMetrics;
+// it's for counter, histogram and summary families of instruments, that observe ended calls (like InstrumentCallCount).
+func FamilyOptions(m openmetrics.MetricFamily, opts ...Option) openmetrics.MetricFamily {
+	return &familyOptions{MetricFamily: m, opts: opts, kind: callFamily}
+}
+
+// InFlightFamilyOptions is like FamilyOptions, but for gauge and histogram families of in-flight call instruments
+// (InstrumentInFlightCalls, InstrumentMessageBytesSent and InstrumentMessageBytesReceived),
+// which leave labels, that are not known until call ends, empty.
+func InFlightFamilyOptions(m openmetrics.MetricFamily, opts ...Option) openmetrics.MetricFamily {
+	return &familyOptions{MetricFamily: m, opts: opts, kind: inFlightFamily}
+}
+
+// CallPhaseFamilyOptions is like FamilyOptions, but for histogram families of InstrumentCallPhaseDuration,
+// it populates "phase" label with every call phase (see CallPhase* constants).
+func CallPhaseFamilyOptions(m openmetrics.MetricFamily, opts ...Option) openmetrics.MetricFamily {
+	return &familyOptions{MetricFamily: m, opts: opts, kind: callPhaseFamily}
+}
+
+type familyOptions struct {
+	openmetrics.MetricFamily
+	opts []Option
+	kind familyKind
+}
+
+// familyKind tells, which instruments metric family is passed to.
+type familyKind int8
+
+const (
+	callFamily      familyKind = iota // instruments, that observe ended calls
+	inFlightFamily                    // in-flight call instruments
+	callPhaseFamily                   // InstrumentCallPhaseDuration
+)
+
+// supports reports whether metric family type is supported by instruments of the kind.
+func (k familyKind) supports(m openmetrics.MetricFamily) bool {
+	switch m.(type) {
+	case openmetrics.CounterFamily, openmetrics.SummaryFamily:
+		return k == callFamily
+	case openmetrics.GaugeFamily:
+		return k == inFlightFamily
+	case openmetrics.HistogramFamily:
+		return true
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------
+
+func initializeFamily(serviceInfo map[string]grpc.ServiceInfo, statusCodes []codes.Code, f *familyOptions) {
+	m := f.MetricFamily
+	desc := m.Desc()
+	if !f.kind.supports(m) {
+		panic(fmt.Sprintf("omgrpc: metric %q of type %q is not supported by its instruments (see InitializeMetrics)", desc.Name, m.Type()))
+	}
+
+	o := newCallOptions(desc, f.opts)
+	o.onLimit = nil // limits are not reported at startup
+
+	phaseIndex := -1
+	if f.kind == callPhaseFamily {
+		phaseIndex = mustLabelIndex(desc, "phase")
+	}
+
+	var calls []CallStats
+	for serviceName, info := range serviceInfo {
+		for _, method := range info.Methods {
+			fullMethodName := "/" + serviceName + "/" + method.Name
+			if f := o.filter; f != nil && (!f.MatchMethod(fullMethodName) || !f.MatchSide(false)) {
+				continue
+			}
+
+			for _, code := range statusCodes {
+				calls = append(calls, CallStats{
+					FullMethodName: fullMethodName,
+					IsClientStream: method.IsClientStream,
+					IsServerStream: method.IsServerStream,
+					Error:          status.Error(code, code.String()),
+					CancelSource:   CancelSourceNone,
+				})
+			}
+		}
+	}
+
+	labeler := buildCallLabeler(desc, o, f.kind == inFlightFamily)
+	switch m := m.(type) {
+	case openmetrics.CounterFamily:
+		initializeSeries(labeler, calls, phaseIndex, func(labels []string) {
+			m.With(labels...)
+		})
+	case openmetrics.HistogramFamily:
+		initializeSeries(labeler, calls, phaseIndex, func(labels []string) {
+			m.With(labels...)
+		})
+	case openmetrics.SummaryFamily:
+		initializeSeries(labeler, calls, phaseIndex, func(labels []string) {
+			m.With(labels...)
+		})
+	case openmetrics.GaugeFamily:
+		initializeSeries(labeler, calls, phaseIndex, func(labels []string) {
+			m.With(labels...).Add(0) // gauges are initialized with NaN and are not exported
+		})
+	}
+}
+
+// initializeSeries creates series for calls (and every call phase, if phaseIndex is not -1),
+// up to the series limit (if any).
+func initializeSeries(labeler *callLabeler, calls []CallStats, phaseIndex int, with func(labels []string)) {
+	for i := range calls {
+		values := labeler.Values(&calls[i])
+		if phaseIndex == -1 {
+			initializeSeriesValues(&values, with)
+			continue
+		}
+		for _, phase := range callPhases {
+			values.Set(phaseIndex, phase)
+			initializeSeriesValues(&values, with)
+		}
+	}
+}
+
+func initializeSeriesValues(values *labelValues, with func(labels []string)) {
+	labels := values.Slice()
+	if values.limiter != nil && len(labels) != 0 && !values.limiter.Allow(labels) {
+		return // no overflow series at startup
+	}
+	with(labels)
+}
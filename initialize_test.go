@@ -0,0 +1,142 @@
+package omgrpc_test
+
+import (
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("InitializeMetrics", func() {
+	var (
+		server       *grpc.Server
+		callCount    openmetrics.CounterFamily
+		callDuration openmetrics.HistogramFamily
+		inFlight     openmetrics.GaugeFamily
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		callCount = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"method", "status"},
+		})
+		callDuration = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_call_duration",
+			Unit:   "seconds",
+			Labels: []string{"method"},
+		}, []float64{.1, 1})
+		inFlight = reg.Gauge(openmetrics.Desc{
+			Name:   "grpc_in_flight_calls",
+			Labels: []string{"method", "status"},
+		})
+
+		server = grpc.NewServer()
+		testpb.RegisterTestServer(server, new(testpb.TestServerImpl))
+	})
+
+	AfterEach(func() {
+		server.Stop()
+	})
+
+	It("initializes series for registered methods", func() {
+		InitializeMetrics(server, callCount, callDuration, InFlightFamilyOptions(inFlight))
+
+		Expect(callCount.NumMetrics()).To(Equal(2))
+		Expect(callCount.With(unaryMethod, "OK").Total()).To(BeZero())
+		Expect(callCount.With(streamMethod, "OK").Total()).To(BeZero())
+
+		Expect(callDuration.NumMetrics()).To(Equal(2))
+		Expect(callDuration.With(unaryMethod).Count()).To(BeZero())
+
+		Expect(inFlight.NumMetrics()).To(Equal(2))
+		Expect(inFlight.With(unaryMethod, "").Value()).To(Equal(0.0))
+		Expect(inFlight.With(streamMethod, "").Value()).To(Equal(0.0))
+	})
+
+	It("initializes series for given codes", func() {
+		InitializeMetricsWithCodes(server, []codes.Code{codes.OK, codes.Internal}, callCount, callDuration)
+
+		Expect(callCount.NumMetrics()).To(Equal(4))
+		Expect(callCount.With(unaryMethod, "Internal").Total()).To(BeZero())
+		Expect(callDuration.NumMetrics()).To(Equal(2))
+	})
+
+	It("populates labels in the same way as instruments", func() {
+		calls := openmetrics.NewConsistentRegistry(mockTime).Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"method", "status_class", "client"},
+		})
+		InitializeMetricsWithCodes(server, []codes.Code{codes.OK, codes.NotFound, codes.Internal},
+			FamilyOptions(calls,
+				WithStatusClasses(map[codes.Code]string{codes.NotFound: StatusClassOK}),
+				FromHeader("client", "x-client-name", "web"),
+				WithDeniedMethods(MatchMethod(streamMethod)),
+			),
+			FamilyOptions(callDuration, WithAllowedMethods(MatchMethod(streamMethod))),
+		)
+
+		Expect(calls.NumMetrics()).To(Equal(2))
+		Expect(calls.With(unaryMethod, "ok", "other").Total()).To(BeZero())
+		Expect(calls.With(unaryMethod, "server_error", "other").Total()).To(BeZero())
+
+		Expect(callDuration.NumMetrics()).To(Equal(1))
+		Expect(callDuration.With(streamMethod).Count()).To(BeZero())
+	})
+
+	It("populates labels of instrument-specific families", func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		phaseDuration := reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_call_phase_duration",
+			Unit:   "seconds",
+			Labels: []string{"method", "phase"},
+		}, []float64{.1, 1})
+		msgBytes := reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_message_bytes_sent",
+			Unit:   "bytes",
+			Labels: []string{"method", "status"},
+		}, []float64{100, 1000})
+		calls := reg.Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"method", "reason"},
+		})
+		InitializeMetrics(server,
+			CallPhaseFamilyOptions(phaseDuration, WithAllowedMethods(MatchMethod(unaryMethod))),
+			InFlightFamilyOptions(msgBytes),
+			FamilyOptions(calls, WithLabel("reason", func(*CallStats) string { return "none" })),
+		)
+
+		Expect(phaseDuration.NumMetrics()).To(Equal(3))
+		Expect(phaseDuration.With(unaryMethod, "queue").Count()).To(BeZero())
+		Expect(phaseDuration.With(unaryMethod, "first_response").Count()).To(BeZero())
+		Expect(phaseDuration.With(unaryMethod, "response_stream").Count()).To(BeZero())
+
+		Expect(msgBytes.NumMetrics()).To(Equal(2))
+		Expect(msgBytes.With(unaryMethod, "").Count()).To(BeZero())
+		Expect(msgBytes.With(streamMethod, "").Count()).To(BeZero())
+
+		Expect(calls.NumMetrics()).To(Equal(2))
+		Expect(calls.With(unaryMethod, "none").Total()).To(BeZero())
+	})
+
+	It("panics on families, not supported by their instruments", func() {
+		Expect(func() { InitializeMetrics(server, inFlight) }).To(Panic())
+		Expect(func() { InitializeMetrics(server, InFlightFamilyOptions(callCount)) }).To(Panic())
+		Expect(func() { InitializeMetrics(server, CallPhaseFamilyOptions(callDuration)) }).To(Panic()) // no "phase" label
+	})
+
+	It("stops at series limit", func() {
+		var limited int
+		InitializeMetricsWithCodes(server, []codes.Code{codes.OK, codes.Internal},
+			FamilyOptions(callCount, WithSeriesLimit(2), WithOnLimit(func(_, _ string) { limited++ })),
+		)
+
+		Expect(callCount.NumMetrics()).To(Equal(2))
+		Expect(limited).To(BeZero())
+	})
+})
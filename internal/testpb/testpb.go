@@ -4,6 +4,10 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 // TODO: review and maybe switch to https://pkg.go.dev/google.golang.org/grpc@v1.39.1/test/grpc_testing#UnsafeTestServiceServer
@@ -11,11 +15,21 @@ import (
 type TestServerImpl struct {
 	UnimplementedTestServer
 
-	UnaryError  error
-	StreamError error
+	UnaryError   error
+	UnaryTrailer metadata.MD
+	UnaryDelay   time.Duration // ignores context cancellation
+	StreamError  error
 }
 
 func (s *TestServerImpl) Unary(ctx context.Context, req *Message) (*Message, error) {
+	if s.UnaryTrailer != nil {
+		if err := grpc.SetTrailer(ctx, s.UnaryTrailer); err != nil {
+			return nil, err
+		}
+	}
+	if s.UnaryDelay != 0 {
+		time.Sleep(s.UnaryDelay)
+	}
 	if s.UnaryError != nil {
 		return nil, s.UnaryError
 	}
@@ -0,0 +1,466 @@
+package omgrpc
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+)
+
+// LabelValueOther is a placeholder label value for unknown or not allowed values.
+const LabelValueOther = "other"
+
+// LabelExtractor extracts call label value from CallStats.
+type LabelExtractor func(*CallStats) string
+
+// FromHeader returns an option to populate call label from header metadata
+// (received one is checked first, then sent) by key.
+//
+// Values are normalized to lower case, missing values and values which are not in the allowed list
+// are populated as LabelValueOther.
+// If no allowed values are given, the number of distinct values is limited to 100 (see WithLabelLimit to override it).
+//
+// Headers are not known when call begins, so the label is left empty by in-flight instruments (like InstrumentInFlightCalls).
+func FromHeader(label, key string, allowed ...string) Option {
+	return withMetadataLabel(label, buildMetadataExtractor(key, allowed, func(call *CallStats) (metadata.MD, metadata.MD) {
+		return call.InHeader, call.OutHeader
+	}), allowed)
+}
+
+// FromTrailer returns an option to populate call label from trailer metadata
+// (received one is checked first, then sent) by key.
+// Values are normalized and limited in the same way as with FromHeader.
+func FromTrailer(label, key string, allowed ...string) Option {
+	return withMetadataLabel(label, buildMetadataExtractor(key, allowed, func(call *CallStats) (metadata.MD, metadata.MD) {
+		return call.InTrailer, call.OutTrailer
+	}), allowed)
+}
+
+// ConnLabelExtractor extracts connection label value from ConnStats.
+type ConnLabelExtractor func(*ConnStats) string
+
+// ----------------------------------------------------------------------------
+
+// callLabeler extracts call label values for a metric family.
+type callLabeler struct {
+	extractors []LabelExtractor
+	series     *seriesLimiter // nil if series are not limited
+}
+
+func newCallLabeler(desc *openmetrics.Desc, o *options) *callLabeler {
+	return buildCallLabeler(desc, o, false)
+}
+
+func newInFlightCallLabeler(desc *openmetrics.Desc, o *options) *callLabeler {
+	return buildCallLabeler(desc, o, true)
+}
+
+func buildCallLabeler(desc *openmetrics.Desc, o *options, inFlight bool) *callLabeler {
+	extractors := buildCallExtractors(desc.Labels, o.callLabels)
+	for i, l := range desc.Labels {
+		if _, ok := o.callLabels[l]; ok {
+			if inFlight && o.callEndLabels[l] {
+				extractors[i] = returnEmptyString // not known until call ends
+			}
+		} else {
+			name := strings.ToLower(l)
+			switch {
+			case inFlight && callEndLabels[name]:
+				extractors[i] = returnEmptyString // not known until call ends
+			case o.builtinLabels[name] != nil:
+				extractors[i] = o.builtinLabels[name]
+			case methodLabels[name] && o.knownMethods != nil:
+				extractors[i] = o.knownMethods.wrap(extractors[i])
+			}
+		}
+		if limit, ok := o.labelLimits[l]; ok {
+			extractors[i] = limitCallExtractor(extractors[i], limit, o.onLimitFunc(desc.Name, l))
+		}
+	}
+
+	labeler := &callLabeler{extractors: extractors}
+	if o.seriesLimit > 0 {
+		labeler.series = &seriesLimiter{values: newValueLimiter(o.seriesLimit), onLimit: o.onLimitFunc(desc.Name, "")}
+	}
+	return labeler
+}
+
+// Values returns label values for given call, series limit is applied when series is resolved.
+func (l *callLabeler) Values(call *CallStats) labelValues {
+	values := labelValues{limiter: l.series}
+	if len(l.extractors) > maxCachedLabels {
+		values.heap = extractCallLabels(l.extractors, call)
+		return values
+	}
+
+	values.n = len(l.extractors)
+	for i, extract := range l.extractors {
+		values.buf[i] = extract(call)
+	}
+	return values
+}
+
+// callExtractors maps (lower-cased) label names to built-in call label extractors.
+var callExtractors = map[string]LabelExtractor{
+	"method":       extractCallMethod,
+	"service":      extractCallService,
+	"method_name":  extractCallMethodName,
+	"type":         extractCallType,
+	"side":         extractCallSide,
+	"role":         extractCallSide,
+	"fail_fast":    extractCallFailFast,
+	"peer":         extractCallPeer,
+	"local_addr":   extractCallLocalAddr,
+	"status":       extractCallStatus,
+	"code":         extractCallStatus,
+	"status_class": extractCallStatusClass,
+	"error_reason": extractCallErrorReason,
+	"error_domain": extractCallErrorDomain,
+
+	"cancel_source":     extractCallCancelSource,
+	"request_encoding":  extractCallRequestEncoding,
+	"response_encoding": extractCallResponseEncoding,
+}
+
+// callEndLabels holds (lower-cased) label names, which are not known when call begins.
+var callEndLabels = map[string]bool{
+	"peer":         true, // populated with headers
+	"local_addr":   true, // populated with headers
+	"status":       true,
+	"code":         true,
+	"status_class": true,
+	"error_reason": true,
+	"error_domain": true,
+
+	"cancel_source":     true,
+	"request_encoding":  true, // populated with headers
+	"response_encoding": true, // populated with headers
+}
+
+// buildCallExtractors returns extractors for given labels;
+// custom extractors (can be nil) take precedence over built-in ones.
+func buildCallExtractors(labels []string, custom map[string]LabelExtractor) []LabelExtractor {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	extractors := make([]LabelExtractor, 0, len(labels))
+	for _, l := range labels {
+		if extract, ok := custom[l]; ok {
+			extractors = append(extractors, extract)
+		} else if extract, ok := callExtractors[strings.ToLower(l)]; ok {
+			extractors = append(extractors, extract)
+		} else {
+			extractors = append(extractors, returnEmptyString)
+		}
+	}
+	return extractors
+}
+
+func extractCallLabels(extractors []LabelExtractor, call *CallStats) []string {
+	if len(extractors) == 0 {
+		return nil
+	}
+
+	values := make([]string, 0, len(extractors))
+	for _, extract := range extractors {
+		values = append(values, extract(call))
+	}
+	return values
+}
+
+func extractCallMethod(call *CallStats) string {
+	return call.FullMethodName
+}
+
+func extractCallService(call *CallStats) string {
+	service, _ := splitFullMethodName(call.FullMethodName)
+	return service
+}
+
+func extractCallMethodName(call *CallStats) string {
+	_, method := splitFullMethodName(call.FullMethodName)
+	return method
+}
+
+func extractCallType(call *CallStats) string {
+	switch {
+	case call.IsClientStream && call.IsServerStream:
+		return "bidi_stream"
+	case call.IsClientStream:
+		return "client_stream"
+	case call.IsServerStream:
+		return "server_stream"
+	default:
+		return "unary"
+	}
+}
+
+func extractCallSide(call *CallStats) string {
+	return sideName(call.IsClient)
+}
+
+func extractCallFailFast(call *CallStats) string {
+	return strconv.FormatBool(call.FailFast)
+}
+
+func extractCallPeer(call *CallStats) string {
+	return peerHost(call.RemoteAddr)
+}
+
+func extractCallLocalAddr(call *CallStats) string {
+	return addrString(call.LocalAddr)
+}
+
+func extractCallStatus(call *CallStats) string {
+	return call.Code().String()
+}
+
+func extractCallStatusClass(call *CallStats) string {
+	return defaultStatusClasses.Get(call.Code())
+}
+
+func extractCallCancelSource(call *CallStats) string {
+	return call.CancelSource
+}
+
+func extractCallRequestEncoding(call *CallStats) string {
+	if call.IsClient {
+		return encodingName(call.OutCompression)
+	}
+	return receivedEncodingName(call.InCompression)
+}
+
+func extractCallResponseEncoding(call *CallStats) string {
+	if call.IsClient {
+		return receivedEncodingName(call.InCompression)
+	}
+	return encodingName(call.OutCompression)
+}
+
+func returnEmptyString(*CallStats) string {
+	return ""
+}
+
+// ----------------------------------------------------------------------------
+
+// connLabeler extracts connection label values for a metric family.
+type connLabeler struct {
+	extractors []ConnLabelExtractor
+	series     *seriesLimiter // nil if series are not limited
+}
+
+func newConnLabeler(desc *openmetrics.Desc, o *options) *connLabeler {
+	return buildConnLabeler(desc, o, false)
+}
+
+func newActiveConnLabeler(desc *openmetrics.Desc, o *options) *connLabeler {
+	return buildConnLabeler(desc, o, true)
+}
+
+func buildConnLabeler(desc *openmetrics.Desc, o *options, active bool) *connLabeler {
+	extractors := buildConnExtractors(desc.Labels, o.connLabels)
+	for i, l := range desc.Labels {
+		if _, ok := o.connLabels[l]; !ok && active && connEndLabels[strings.ToLower(l)] {
+			extractors[i] = returnEmptyConnString // not known until connection ends
+		}
+		if limit, ok := o.labelLimits[l]; ok {
+			extractors[i] = limitConnExtractor(extractors[i], limit, o.onLimitFunc(desc.Name, l))
+		}
+	}
+
+	labeler := &connLabeler{extractors: extractors}
+	if o.seriesLimit > 0 {
+		labeler.series = &seriesLimiter{values: newValueLimiter(o.seriesLimit), onLimit: o.onLimitFunc(desc.Name, "")}
+	}
+	return labeler
+}
+
+// Values returns label values for given connection, series limit is applied when series is resolved.
+func (l *connLabeler) Values(conn *ConnStats) labelValues {
+	values := labelValues{limiter: l.series}
+	if len(l.extractors) > maxCachedLabels {
+		values.heap = extractConnLabels(l.extractors, conn)
+		return values
+	}
+
+	values.n = len(l.extractors)
+	for i, extract := range l.extractors {
+		values.buf[i] = extract(conn)
+	}
+	return values
+}
+
+// connExtractors maps (lower-cased) label names to built-in connection label extractors.
+var connExtractors = map[string]ConnLabelExtractor{
+	"side":       extractConnSide,
+	"role":       extractConnSide,
+	"peer":       extractConnPeer,
+	"local_addr": extractConnLocalAddr,
+	"reason":     extractConnDisconnectReason,
+}
+
+// connEndLabels holds (lower-cased) label names, which are not known until connection ends.
+var connEndLabels = map[string]bool{
+	"reason": true,
+}
+
+// buildConnExtractors returns extractors for given labels;
+// custom extractors (can be nil) take precedence over built-in ones.
+func buildConnExtractors(labels []string, custom map[string]ConnLabelExtractor) []ConnLabelExtractor {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	extractors := make([]ConnLabelExtractor, 0, len(labels))
+	for _, l := range labels {
+		if extract, ok := custom[l]; ok {
+			extractors = append(extractors, extract)
+		} else if extract, ok := connExtractors[strings.ToLower(l)]; ok {
+			extractors = append(extractors, extract)
+		} else {
+			extractors = append(extractors, returnEmptyConnString)
+		}
+	}
+	return extractors
+}
+
+func extractConnLabels(extractors []ConnLabelExtractor, conn *ConnStats) []string {
+	if len(extractors) == 0 {
+		return nil
+	}
+
+	values := make([]string, 0, len(extractors))
+	for _, extract := range extractors {
+		values = append(values, extract(conn))
+	}
+	return values
+}
+
+func extractConnSide(conn *ConnStats) string {
+	return sideName(conn.IsClient)
+}
+
+func extractConnPeer(conn *ConnStats) string {
+	return peerHost(conn.RemoteAddr)
+}
+
+func extractConnLocalAddr(conn *ConnStats) string {
+	return addrString(conn.LocalAddr)
+}
+
+func extractConnDisconnectReason(conn *ConnStats) string {
+	return conn.DisconnectReason
+}
+
+func returnEmptyConnString(*ConnStats) string {
+	return ""
+}
+
+// ----------------------------------------------------------------------------
+
+// defaultMetadataLabelLimit is the max number of distinct metadata label values, when allowed values are not given.
+const defaultMetadataLabelLimit = 100
+
+// withMetadataLabel sets custom call label extractor, which is not known until call ends,
+// values are limited by default, unless they are allowed explicitly.
+func withMetadataLabel(label string, extract LabelExtractor, allowed []string) Option {
+	return func(o *options) {
+		WithLabel(label, extract)(o)
+
+		if o.callEndLabels == nil {
+			o.callEndLabels = make(map[string]bool, 1)
+		}
+		o.callEndLabels[labelKey(label)] = true
+
+		if _, ok := o.labelLimits[labelKey(label)]; !ok && len(allowed) == 0 {
+			WithLabelLimit(label, defaultMetadataLabelLimit)(o)
+		}
+	}
+}
+
+func buildMetadataExtractor(key string, allowed []string, get func(*CallStats) (metadata.MD, metadata.MD)) LabelExtractor {
+	var allowedValues map[string]bool
+	if len(allowed) != 0 {
+		allowedValues = make(map[string]bool, len(allowed))
+		for _, v := range allowed {
+			allowedValues[normalizeMetadataValue(v)] = true
+		}
+	}
+
+	return func(call *CallStats) string {
+		in, out := get(call)
+
+		values := in.Get(key)
+		if len(values) == 0 {
+			values = out.Get(key)
+		}
+		if len(values) == 0 {
+			return LabelValueOther
+		}
+
+		v := normalizeMetadataValue(values[0])
+		if allowedValues != nil && !allowedValues[v] {
+			return LabelValueOther
+		}
+		return v
+	}
+}
+
+func normalizeMetadataValue(v string) string {
+	return strings.ToLower(strings.TrimSpace(v))
+}
+
+// splitFullMethodName splits "/com.package.Service/MethodName" into service and method names.
+func splitFullMethodName(fullMethodName string) (service, method string) {
+	name := strings.TrimPrefix(fullMethodName, "/")
+	if pos := strings.LastIndexByte(name, '/'); pos >= 0 {
+		return name[:pos], name[pos+1:]
+	}
+	return "", name
+}
+
+func encodingName(compression string) string {
+	if compression == "" {
+		return "identity"
+	}
+	return compression
+}
+
+// receivedEncodingName is like encodingName, but compression is set by peer,
+// so compressors, which are not registered (see google.golang.org/grpc/encoding), are populated as LabelValueOther.
+func receivedEncodingName(compression string) string {
+	if compression != "" && encoding.GetCompressor(compression) == nil {
+		return LabelValueOther
+	}
+	return encodingName(compression)
+}
+
+func sideName(isClient bool) string {
+	if isClient {
+		return "client"
+	}
+	return "server"
+}
+
+func peerHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host // ports are mostly random, strip them
+	}
+	return s
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
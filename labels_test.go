@@ -0,0 +1,117 @@
+package omgrpc_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("FromHeader/FromTrailer", func() {
+	var (
+		ctx = context.Background()
+
+		clientCalls openmetrics.CounterFamily
+		serverCalls openmetrics.CounterFamily
+		client      testpb.TestClient
+		clientClose func()
+		teardown    func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		clientCalls = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_client_calls",
+			Labels: []string{"client", "cache"},
+		})
+		serverCalls = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_server_calls",
+			Labels: []string{"client", "cache"},
+		})
+
+		client, clientClose, teardown = initClientServerSystemWith(
+			&testpb.TestServerImpl{UnaryTrailer: metadata.Pairs("x-cache", "HIT")},
+			[]grpc.DialOption{
+				grpc.WithStatsHandler(InstrumentCallCount(clientCalls,
+					FromHeader("client", "x-client-name", "mobile", "web"),
+					FromTrailer("cache", "x-cache"),
+				)),
+			},
+			[]grpc.ServerOption{
+				grpc.StatsHandler(InstrumentCallCount(serverCalls,
+					FromHeader("client", "x-client-name", "mobile", "web"),
+					FromTrailer("cache", "X-Cache", "hit", "miss"),
+				)),
+			},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("populates labels from metadata", func() {
+		for _, name := range []string{" Mobile ", "web", "hacker-1", "hacker-2"} {
+			_, err := client.Unary(metadata.AppendToOutgoingContext(ctx, "x-client-name", name), &testpb.Message{Payload: "1"})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+		clientClose()
+
+		Expect(clientCalls.NumMetrics()).To(Equal(3))
+		Expect(clientCalls.With("mobile", "hit").Total()).To(Equal(1.0))
+		Expect(clientCalls.With("web", "hit").Total()).To(Equal(1.0))
+		Expect(clientCalls.With("other", "hit").Total()).To(Equal(3.0))
+
+		Expect(serverCalls.NumMetrics()).To(Equal(3))
+		Expect(serverCalls.With("mobile", "hit").Total()).To(Equal(1.0))
+		Expect(serverCalls.With("web", "hit").Total()).To(Equal(1.0))
+		Expect(serverCalls.With("other", "hit").Total()).To(Equal(3.0))
+	})
+
+	It("limits values, which are not allowed explicitly", func() {
+		calls := openmetrics.NewConsistentRegistry(mockTime).Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"client"},
+		})
+		handler := InstrumentCallCount(calls, FromHeader("client", "x-client-name"))
+
+		call := newMockCall(unaryMethod)
+		for i := 0; i < 150; i++ {
+			call.inHeader.Header = metadata.Pairs("x-client-name", fmt.Sprintf("hacker-%d", i))
+			call.run(handler, 1)
+		}
+
+		Expect(calls.NumMetrics()).To(Equal(101))
+		Expect(calls.With("hacker-0").Total()).To(Equal(1.0))
+		Expect(calls.With("other").Total()).To(Equal(50.0))
+	})
+
+	It("leaves labels empty for in-flight calls", func() {
+		inFlight := openmetrics.NewConsistentRegistry(mockTime).Gauge(openmetrics.Desc{
+			Name:   "grpc_in_flight_calls",
+			Labels: []string{"client", "cache"},
+		})
+		handler := InstrumentInFlightCalls(inFlight,
+			FromHeader("client", "x-client-name", "web"),
+			FromTrailer("cache", "x-cache"),
+		)
+
+		call := newMockCall(unaryMethod)
+		call.inHeader.Header = metadata.Pairs("x-client-name", "web")
+		call.outTrailer.Trailer = metadata.Pairs("x-cache", "hit")
+		call.run(handler, 1)
+
+		Expect(inFlight.NumMetrics()).To(Equal(1))
+		Expect(inFlight.With("", "").Value()).To(Equal(0.0))
+	})
+})
@@ -0,0 +1,182 @@
+package omgrpc
+
+import (
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// LabelValueUnknown is a label value for server methods, which are not registered (see WithKnownMethods).
+const LabelValueUnknown = "unknown"
+
+// WithLabelLimit limits the number of distinct label values,
+// values over the limit are populated as LabelValueOther.
+// Label name must be one of the metric family labels (case-insensitive), Instrument* functions panic otherwise.
+func WithLabelLimit(label string, limit int) Option {
+	return func(o *options) {
+		if o.labelLimits == nil {
+			o.labelLimits = make(map[string]int, 1)
+		}
+		o.labelLimits[labelKey(label)] = limit
+	}
+}
+
+// WithSeriesLimit limits the number of distinct label value combinations (series) per metric family,
+// series over the limit have all the label values populated as LabelValueOther.
+// Label values of metric families with up to 8 labels are resolved without allocations,
+// families with more labels allocate label values on every observation.
+func WithSeriesLimit(limit int) Option {
+	return func(o *options) {
+		o.seriesLimit = limit
+	}
+}
+
+// WithKnownMethods collapses method labels ("method", "service" and "method_name") of server-side calls
+// to methods, which are not registered, into LabelValueUnknown.
+// Such calls are reported only by servers with grpc.UnknownServiceHandler option.
+//
+// Service info is resolved lazily on the first server-side call,
+// so it can refer to the server, which is not created yet:
+//
+//	var server *grpc.Server
+//	server = grpc.NewServer(grpc.StatsHandler(omgrpc.InstrumentCallCount(callCount,
+//	  omgrpc.WithKnownMethods(func() map[string]grpc.ServiceInfo { return server.GetServiceInfo() }),
+//	)))
+func WithKnownMethods(serviceInfo func() map[string]grpc.ServiceInfo) Option {
+	known := &knownMethods{serviceInfo: serviceInfo}
+	return func(o *options) {
+		o.knownMethods = known
+	}
+}
+
+// WithOnLimit sets a callback, which is invoked every time a label value is discarded because of a limit
+// (label is empty for series limit), for example, to increment a counter.
+// It's invoked concurrently by calls, so it must be safe for concurrent use.
+func WithOnLimit(fn func(metric, label string)) Option {
+	return func(o *options) {
+		o.onLimit = fn
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// valueLimiter admits up to limit distinct values.
+type valueLimiter struct {
+	limit int
+	seen  map[string]struct{}
+	mu    sync.RWMutex
+}
+
+func newValueLimiter(limit int) *valueLimiter {
+	return &valueLimiter{limit: limit, seen: make(map[string]struct{})}
+}
+
+// Allow reports whether value is already seen or can be admitted.
+func (l *valueLimiter) Allow(value string) bool {
+	l.mu.RLock()
+	_, ok := l.seen[value]
+	l.mu.RUnlock()
+	if ok {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.seen[value]; ok {
+		return true
+	}
+	if len(l.seen) >= l.limit {
+		return false
+	}
+	l.seen[value] = struct{}{}
+	return true
+}
+
+// seriesLimiter admits up to limit distinct label value combinations.
+type seriesLimiter struct {
+	values  *valueLimiter
+	onLimit func()
+}
+
+// Allow reports whether label values are already seen or can be admitted.
+func (l *seriesLimiter) Allow(values []string) bool {
+	return l.values.Allow(strings.Join(values, "\xff")) // 0xff never appears in valid UTF-8 strings
+}
+
+// overflow replaces label values, which are over the limit, with LabelValueOther.
+func (l *seriesLimiter) overflow(values []string) []string {
+	for i := range values {
+		values[i] = LabelValueOther
+	}
+	if l.onLimit != nil {
+		l.onLimit()
+	}
+	return values
+}
+
+func limitCallExtractor(extract LabelExtractor, limit int, onLimit func()) LabelExtractor {
+	values := newValueLimiter(limit)
+	return func(call *CallStats) string {
+		if v := extract(call); values.Allow(v) {
+			return v
+		}
+		if onLimit != nil {
+			onLimit()
+		}
+		return LabelValueOther
+	}
+}
+
+func limitConnExtractor(extract ConnLabelExtractor, limit int, onLimit func()) ConnLabelExtractor {
+	values := newValueLimiter(limit)
+	return func(conn *ConnStats) string {
+		if v := extract(conn); values.Allow(v) {
+			return v
+		}
+		if onLimit != nil {
+			onLimit()
+		}
+		return LabelValueOther
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// knownMethods holds registered server methods, resolved lazily.
+type knownMethods struct {
+	serviceInfo func() map[string]grpc.ServiceInfo
+	methods     map[string]struct{}
+	once        sync.Once
+}
+
+func (k *knownMethods) Has(fullMethodName string) bool {
+	k.once.Do(func() {
+		k.methods = make(map[string]struct{})
+		for serviceName, info := range k.serviceInfo() {
+			for _, method := range info.Methods {
+				k.methods["/"+serviceName+"/"+method.Name] = struct{}{}
+			}
+		}
+	})
+
+	_, ok := k.methods[fullMethodName]
+	return ok
+}
+
+func (k *knownMethods) wrap(extract LabelExtractor) LabelExtractor {
+	return func(call *CallStats) string {
+		if !call.IsClient && !k.Has(call.FullMethodName) {
+			return LabelValueUnknown
+		}
+		return extract(call)
+	}
+}
+
+// methodLabels holds (lower-cased) names of built-in labels, derived from method name.
+var methodLabels = map[string]bool{
+	"method":      true,
+	"service":     true,
+	"method_name": true,
+}
@@ -0,0 +1,121 @@
+package omgrpc_test
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("Limits", func() {
+	var (
+		ctx = context.Background()
+
+		callCount   openmetrics.CounterFamily
+		limitsHit   map[string]int
+		limitsMu    sync.Mutex // limits are hit concurrently by calls
+		client      testpb.TestClient
+		clientClose func()
+		teardown    func()
+	)
+
+	callWithClient := func(name string) {
+		_, err := client.Unary(metadata.AppendToOutgoingContext(ctx, "x-client-name", name), &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	setup := func(opts ...Option) {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		callCount = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"method", "client"},
+		})
+
+		limitsHit = make(map[string]int)
+		opts = append(opts,
+			FromHeader("client", "x-client-name"),
+			WithOnLimit(func(metric, label string) {
+				limitsMu.Lock()
+				defer limitsMu.Unlock()
+				limitsHit[metric+"/"+label]++
+			}),
+		)
+
+		client, clientClose, teardown = initClientServerSystem(
+			nil,
+			[]grpc.ServerOption{
+				grpc.StatsHandler(InstrumentCallCount(callCount, opts...)),
+			},
+		)
+	}
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("limits label values", func() {
+		setup(WithLabelLimit("client", 2))
+
+		for _, name := range []string{"a", "b", "c", "a", "d"} {
+			callWithClient(name)
+		}
+		clientClose()
+
+		Expect(callCount.NumMetrics()).To(Equal(3))
+		Expect(callCount.With(unaryMethod, "a").Total()).To(Equal(2.0))
+		Expect(callCount.With(unaryMethod, "b").Total()).To(Equal(1.0))
+		Expect(callCount.With(unaryMethod, "other").Total()).To(Equal(2.0))
+		limitsMu.Lock()
+		defer limitsMu.Unlock()
+		Expect(limitsHit).To(Equal(map[string]int{"grpc_calls/client": 2}))
+	})
+
+	It("limits series", func() {
+		setup(WithSeriesLimit(2))
+
+		for _, name := range []string{"a", "b", "c", "a", "d"} {
+			callWithClient(name)
+		}
+		clientClose()
+
+		Expect(callCount.NumMetrics()).To(Equal(3))
+		Expect(callCount.With(unaryMethod, "a").Total()).To(Equal(2.0))
+		Expect(callCount.With(unaryMethod, "b").Total()).To(Equal(1.0))
+		Expect(callCount.With("other", "other").Total()).To(Equal(2.0))
+		limitsMu.Lock()
+		defer limitsMu.Unlock()
+		Expect(limitsHit).To(Equal(map[string]int{"grpc_calls/": 2}))
+	})
+
+	It("collapses unknown methods", func() {
+		setup(WithKnownMethods(func() map[string]grpc.ServiceInfo {
+			return map[string]grpc.ServiceInfo{
+				"com.blacksquaremedia.omgrpc.internal.testpb.Test": {
+					Methods: []grpc.MethodInfo{{Name: "Unary"}},
+				},
+			}
+		}))
+
+		callWithClient("a")
+
+		stream, err := client.Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.CloseSend()).To(Succeed())
+		_, err = stream.Recv()
+		Expect(err).To(Equal(io.EOF))
+		clientClose()
+
+		Expect(callCount.NumMetrics()).To(Equal(2))
+		Expect(callCount.With(unaryMethod, "a").Total()).To(Equal(1.0))
+		Expect(callCount.With("unknown", "other").Total()).To(Equal(1.0))
+	})
+})
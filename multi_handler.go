@@ -0,0 +1,351 @@
+package omgrpc
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/stats"
+)
+
+// maxCallGroups is the max number of differently filtered call handler groups (CallStats.groups bit mask size).
+const maxCallGroups = 64
+
+// MultiHandler implements https://pkg.go.dev/google.golang.org/grpc/stats#Handler
+// and dispatches collected stats to multiple handlers.
+//
+// RPC and connection contexts are tagged only once, so a single CallStats/ConnStats
+// is accumulated per RPC call/connection and then submitted to all the call/connection handlers.
+type MultiHandler struct {
+	call   callCallbacks   // combined call handlers
+	groups []*callGroup    // call handlers, grouped by filter
+	conn   connCallbacks   // combined connection handlers
+	other  []stats.Handler // generic (non-omgrpc) handlers, called in sequence
+
+	timelineLimit   int           // max number of call timeline events, 0 if not recorded
+	disconnectGrace time.Duration // max client disconnect delay, 0 if reported synchronously
+
+	connHandlers    []ConnStatsHandler
+	trafficHandlers []ConnTrafficHandler
+}
+
+// callGroup holds call handlers, that share the same filter.
+type callGroup struct {
+	filter          *callFilter // nil if not filtered
+	beginHandlers   []CallBeginHandler
+	messageHandlers []MessageStatsHandler
+	endHandlers     []CallStatsHandler
+}
+
+// Instrument combines given handlers into a single stats.Handler
+// to be used with grpc.StatsHandler / grpc.WithStatsHandler options,
+// which accept only one handler:
+//
+//	grpc.NewServer(
+//	  grpc.StatsHandler(omgrpc.Instrument(
+//	    omgrpc.InstrumentCallCount(callCount),
+//	    omgrpc.InstrumentCallDuration(callDuration),
+//	    omgrpc.InstrumentActiveConns(activeConns),
+//	  )),
+//	)
+//
+// CallStatsHandler, CallBeginHandler, MessageStatsHandler, ConnStatsHandler, ConnTrafficHandler
+// (including ones returned by Instrument* functions) and nested *MultiHandler share the same CallStats/ConnStats.
+// Any other stats.Handler is supported as well, but is called separately.
+func Instrument(handlers ...stats.Handler) *MultiHandler {
+	m := new(MultiHandler)
+	for _, h := range handlers {
+		m.add(h)
+	}
+	m.compile()
+	return m
+}
+
+// newFilteredHandler returns a handler, that dispatches only calls accepted by filter to h.
+func newFilteredHandler(filter *callFilter, h stats.Handler) *MultiHandler {
+	m := new(MultiHandler)
+	m.add(h)
+	for _, g := range m.groups {
+		if g.filter == nil {
+			g.filter = filter
+		}
+	}
+	m.compile()
+	return m
+}
+
+// WithDisconnectGrace returns a handler, that delays client connection disconnect up to grace period,
+// till all the calls, that were in flight on the connection, end: calls tell disconnect reason
+// (see DisconnectReason* constants), but grpc reports them after disconnect, and only when they are read.
+// Delayed disconnect is reported from a separate goroutine, when grace period is over, or by the last ended call:
+//
+//	omgrpc.Instrument(
+//	  omgrpc.InstrumentActiveConns(activeConns),
+//	  omgrpc.InstrumentConnClosed(connClosed),
+//	).WithDisconnectGrace(200 * time.Millisecond)
+//
+// By default disconnect is reported synchronously, when grpc reports it.
+func (m *MultiHandler) WithDisconnectGrace(grace time.Duration) *MultiHandler {
+	w := new(MultiHandler)
+	w.add(m)
+	w.disconnectGrace = grace
+	w.compile()
+	return w
+}
+
+func (m *MultiHandler) add(h stats.Handler) {
+	switch h := h.(type) {
+	case CallBeginHandler:
+		g := m.unfilteredGroup()
+		g.beginHandlers = append(g.beginHandlers, h)
+	case MessageStatsHandler:
+		g := m.unfilteredGroup()
+		g.messageHandlers = append(g.messageHandlers, h)
+	case CallStatsHandler:
+		g := m.unfilteredGroup()
+		g.endHandlers = append(g.endHandlers, h)
+	case ConnStatsHandler:
+		m.connHandlers = append(m.connHandlers, h)
+	case ConnTrafficHandler:
+		m.trafficHandlers = append(m.trafficHandlers, h)
+	case *MultiHandler:
+		for _, hg := range h.groups {
+			if hg.filter != nil {
+				m.groups = append(m.groups, hg) // never modified, so can be shared
+				continue
+			}
+
+			g := m.unfilteredGroup()
+			g.beginHandlers = append(g.beginHandlers, hg.beginHandlers...)
+			g.messageHandlers = append(g.messageHandlers, hg.messageHandlers...)
+			g.endHandlers = append(g.endHandlers, hg.endHandlers...)
+		}
+		m.connHandlers = append(m.connHandlers, h.connHandlers...)
+		m.trafficHandlers = append(m.trafficHandlers, h.trafficHandlers...)
+		m.other = append(m.other, h.other...)
+		if h.timelineLimit > m.timelineLimit {
+			m.timelineLimit = h.timelineLimit
+		}
+		if h.disconnectGrace > m.disconnectGrace {
+			m.disconnectGrace = h.disconnectGrace
+		}
+	default:
+		m.other = append(m.other, h)
+	}
+}
+
+func (m *MultiHandler) unfilteredGroup() *callGroup {
+	for _, g := range m.groups {
+		if g.filter == nil {
+			return g
+		}
+	}
+
+	g := new(callGroup)
+	m.groups = append(m.groups, g)
+	return g
+}
+
+func (m *MultiHandler) compile() {
+	if len(m.groups) > maxCallGroups {
+		panic("omgrpc: too many differently filtered call handlers")
+	}
+
+	if len(m.groups) == 1 && m.groups[0].filter == nil {
+		m.call = m.groups[0].callbacks()
+	} else if len(m.groups) != 0 {
+		m.call = compileGroupCallbacks(m.groups)
+	}
+
+	m.conn.disconnectGrace = m.disconnectGrace
+	m.conn.conns = newConnsByAddr()
+	switch len(m.connHandlers) {
+	case 0:
+	case 1:
+		m.conn.stats = m.connHandlers[0]
+	default:
+		connHandlers := m.connHandlers
+		m.conn.stats = func(conn *ConnStats) {
+			for _, h := range connHandlers {
+				h(conn)
+			}
+		}
+	}
+
+	switch len(m.trafficHandlers) {
+	case 0:
+	case 1:
+		m.conn.traffic = m.trafficHandlers[0]
+	default:
+		trafficHandlers := m.trafficHandlers
+		m.conn.traffic = func(conn *ConnStats, bytesRecv, bytesSent int) {
+			for _, h := range trafficHandlers {
+				h(conn, bytesRecv, bytesSent)
+			}
+		}
+	}
+}
+
+// TagRPC attaches omgrpc-internal data to RPC context.
+func (m *MultiHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	// client call is linked to its connection by call context, if any, to avoid allocations:
+	linkConn := !m.conn.isEmpty() && !isServerRPC(ctx)
+	if !m.call.isEmpty() {
+		if groups := m.matchGroups(info); groups != 0 {
+			call := newCallStats(ctx, info)
+			call.groups = groups
+			if m.timelineLimit > 0 {
+				call.Timeline = make(CallTimeline, 0, m.timelineLimit)
+			}
+			ctx = setCallStats(ctx, call, linkConn)
+		} else {
+			ctx = setCallStats(ctx, nil, linkConn) // filtered out, make sure that outer (server) call stats are not used
+		}
+	} else if linkConn {
+		ctx = setCallConn(ctx)
+	}
+	for _, h := range m.other {
+		ctx = h.TagRPC(ctx, info)
+	}
+	return ctx
+}
+
+// HandleRPC processes the RPC stats.
+func (m *MultiHandler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
+	if !m.conn.isEmpty() {
+		handleConnRPC(ctx, stat, m.conn)
+	}
+	if !m.call.isEmpty() {
+		handleCallStats(ctx, stat, m.call)
+	}
+	for _, h := range m.other {
+		h.HandleRPC(ctx, stat)
+	}
+}
+
+// TagConn attaches omgrpc-internal data to connection context.
+func (m *MultiHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	if !m.conn.isEmpty() {
+		ctx = tagConn(ctx, info)
+	}
+	for _, h := range m.other {
+		ctx = h.TagConn(ctx, info)
+	}
+	return ctx
+}
+
+// HandleConn processes the connection stats.
+func (m *MultiHandler) HandleConn(ctx context.Context, stat stats.ConnStats) {
+	if !m.conn.isEmpty() {
+		handleConn(ctx, stat, m.conn)
+	}
+	for _, h := range m.other {
+		h.HandleConn(ctx, stat)
+	}
+}
+
+// matchGroups returns a bit mask of call groups, that accept the tagged call.
+func (m *MultiHandler) matchGroups(info *stats.RPCTagInfo) (mask uint64) {
+	for i, g := range m.groups {
+		if g.filter == nil || g.filter.MatchTag(info) {
+			mask |= 1 << i
+		}
+	}
+	return mask
+}
+
+// ----------------------------------------------------------------------------
+
+func (g *callGroup) callbacks() (cb callCallbacks) {
+	switch len(g.beginHandlers) {
+	case 0:
+	case 1:
+		cb.begin = g.beginHandlers[0]
+	default:
+		beginHandlers := g.beginHandlers
+		cb.begin = func(call *CallStats) {
+			for _, h := range beginHandlers {
+				h(call)
+			}
+		}
+	}
+
+	switch len(g.messageHandlers) {
+	case 0:
+	case 1:
+		cb.message = g.messageHandlers[0]
+	default:
+		messageHandlers := g.messageHandlers
+		cb.message = func(call *CallStats, msg *MessageStats) {
+			for _, h := range messageHandlers {
+				h(call, msg)
+			}
+		}
+	}
+
+	switch len(g.endHandlers) {
+	case 0:
+	case 1:
+		cb.end = g.endHandlers[0]
+	default:
+		endHandlers := g.endHandlers
+		cb.end = func(call *CallStats) {
+			for _, h := range endHandlers {
+				h(call)
+			}
+		}
+	}
+
+	return cb
+}
+
+// compileGroupCallbacks combines callbacks of call groups;
+// they are dispatched only to the groups, that are active for the call.
+func compileGroupCallbacks(groups []*callGroup) callCallbacks {
+	callbacks := make([]callCallbacks, len(groups))
+	var hasMessage, hasEnd bool
+	for i, g := range groups {
+		callbacks[i] = g.callbacks()
+		hasMessage = hasMessage || callbacks[i].message != nil
+		hasEnd = hasEnd || callbacks[i].end != nil
+	}
+
+	var cb callCallbacks
+
+	// begin callback is always needed to apply side filters (call side is not always known when tagged):
+	cb.begin = func(call *CallStats) {
+		for i, g := range groups {
+			if call.groups&(1<<i) == 0 {
+				continue
+			}
+			if g.filter != nil && !g.filter.MatchSide(call.IsClient) {
+				call.groups &^= 1 << i
+				continue
+			}
+			if begin := callbacks[i].begin; begin != nil {
+				begin(call)
+			}
+		}
+	}
+
+	if hasMessage {
+		cb.message = func(call *CallStats, msg *MessageStats) {
+			for i := range groups {
+				if message := callbacks[i].message; message != nil && call.groups&(1<<i) != 0 {
+					message(call, msg)
+				}
+			}
+		}
+	}
+
+	if hasEnd {
+		cb.end = func(call *CallStats) {
+			for i := range groups {
+				if end := callbacks[i].end; end != nil && call.groups&(1<<i) != 0 {
+					end(call)
+				}
+			}
+		}
+	}
+
+	return cb
+}
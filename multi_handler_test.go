@@ -0,0 +1,137 @@
+package omgrpc_test
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("MultiHandler", func() {
+	var (
+		ctx = context.Background()
+
+		subject      *MultiHandler
+		mu           sync.Mutex // client and server submit stats concurrently
+		callStats    []CallStats
+		connStats    []ConnStats
+		callCount    openmetrics.CounterFamily
+		callDuration openmetrics.HistogramFamily
+		activeConns  openmetrics.GaugeFamily
+		client       testpb.TestClient
+		clientClose  func()
+		teardown     func()
+	)
+
+	BeforeEach(func() {
+		callStats = callStats[:0]
+		connStats = connStats[:0]
+
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		callCount = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"method", "status"},
+		})
+		callDuration = reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_call_duration",
+			Unit:   "seconds",
+			Labels: []string{"method", "status"},
+		}, []float64{.1, 1})
+		activeConns = reg.Gauge(openmetrics.Desc{
+			Name: "grpc_active_conns",
+		})
+
+		subject = Instrument(
+			Instrument(
+				InstrumentCallCount(callCount),
+				InstrumentCallDuration(callDuration),
+			),
+			InstrumentActiveConns(activeConns),
+			CallStatsHandler(func(call *CallStats) {
+				mu.Lock()
+				defer mu.Unlock()
+				callStats = append(callStats, *call)
+			}),
+			ConnStatsHandler(func(conn *ConnStats) {
+				mu.Lock()
+				defer mu.Unlock()
+				connStats = append(connStats, *conn)
+			}),
+		)
+
+		client, clientClose, teardown = initClientServerSystem(
+			[]grpc.DialOption{
+				grpc.WithStatsHandler(subject),
+			},
+			[]grpc.ServerOption{
+				grpc.StatsHandler(subject),
+			},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("dispatches stats to all handlers", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(activeConns.With().Value()).To(Equal(2.0)) // client + server
+
+		clientClose()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		Expect(callStats).To(HaveLen(2))
+		Expect(callStats[0].IsClient).NotTo(Equal(callStats[1].IsClient))
+		Expect(callStats[0].BytesRecv + callStats[0].BytesSent).To(Equal(23))
+		Expect(callStats[1].BytesRecv + callStats[1].BytesSent).To(Equal(23))
+
+		Expect(connStats).To(HaveLen(4)) // connect + disconnect, client + server
+
+		Expect(callCount.With(unaryMethod, "OK").Total()).To(Equal(2.0))
+		Expect(callDuration.With(unaryMethod, "OK").Count()).To(Equal(int64(2)))
+		Expect(activeConns.With().Value()).To(Equal(0.0))
+	})
+	It("links client calls to connections of its own", func() {
+		other := Instrument(ConnStatsHandler(func(conn *ConnStats) {
+			mu.Lock()
+			defer mu.Unlock()
+			connStats = append(connStats, *conn)
+		}))
+
+		// in-memory connections have the same addresses, but belong to different handlers:
+		otherClient, otherClose, otherTeardown := initClientServerSystem(
+			[]grpc.DialOption{grpc.WithStatsHandler(other)},
+			nil,
+		)
+		defer otherTeardown()
+
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = otherClient.Unary(ctx, &testpb.Message{Payload: "2"})
+		Expect(err).NotTo(HaveOccurred())
+		otherClose()
+		clientClose()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		var clientCalls int
+		for _, s := range connStats {
+			if s.IsClient {
+				clientCalls += s.Calls
+			}
+		}
+		Expect(clientCalls).To(Equal(2))
+	})
+})
@@ -1,2 +1,29 @@
 // Package omgrpc provides helpers to track grpc/openmetrics.
+//
+// # Call labels
+//
+// Instrument* functions for RPC calls populate metric family labels
+// they can recognize (case-insensitive) and leave others empty:
+//
+//   - "method" - full method name like "/com.package.Service/MethodName"
+//   - "service" - service name like "com.package.Service"
+//   - "method_name" - method name like "MethodName"
+//   - "type" - RPC type: "unary", "client_stream", "server_stream" or "bidi_stream"
+//   - "side" or "role" - "client" or "server"
+//   - "fail_fast" - "true" or "false" (always "false" for server side)
+//   - "peer" - remote host (without port)
+//   - "local_addr" - local address
+//   - "status" or "code" - populated with gRPC code string: https://pkg.go.dev/google.golang.org/grpc/codes#Code
+//   - "status_class" - "ok", "client_error", "server_error" or "timeout" (see StatusClass and WithStatusClasses)
+//   - "error_reason" and "error_domain" - reason and domain of google.rpc.ErrorInfo status detail, if any
+//     (values, that are not allowed with WithErrorReasons and WithErrorDomains, are populated as "other")
+//   - "cancel_source" - "none", "client", "deadline", "connection" or "server" (see CancelSource* constants)
+//   - "request_encoding" and "response_encoding" - compression (grpc-encoding) of request and response messages,
+//     "identity" if not compressed, "other" if received one is not registered (see google.golang.org/grpc/encoding)
+//
+// This allows one family to be shared by client and server handlers.
+// Custom labels can be populated with WithLabel, FromHeader and FromTrailer options.
+// Label cardinality can be limited with WithLabelLimit, WithSeriesLimit and WithKnownMethods options.
+// Label values, that come from peers (metadata and error details), are limited by default,
+// so peers cannot blow up series cardinality.
 package omgrpc
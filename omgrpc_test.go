@@ -2,14 +2,22 @@ package omgrpc_test
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/test/bufconn"
 
+	. "github.com/bsm/omgrpc"
+
 	. "github.com/bsm/ginkgo"
 	. "github.com/bsm/gomega"
 )
@@ -19,6 +27,10 @@ func TestSuite(t *testing.T) {
 	RunSpecs(t, "omgrpc")
 }
 
+func mockTime() time.Time {
+	return time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+}
+
 func initClientServerSystem(
 	clientOptions []grpc.DialOption,
 	serverOptions []grpc.ServerOption,
@@ -26,11 +38,38 @@ func initClientServerSystem(
 	testClient testpb.TestClient,
 	clientClose func(),
 	teardown func(),
+) {
+	return initClientServerSystemWith(new(testpb.TestServerImpl), clientOptions, serverOptions)
+}
+
+func initClientServerSystemWith(
+	serverImpl *testpb.TestServerImpl,
+	clientOptions []grpc.DialOption,
+	serverOptions []grpc.ServerOption,
+) (
+	testClient testpb.TestClient,
+	clientClose func(),
+	teardown func(),
+) {
+	_, testClient, clientClose, teardown = initClientServerSystemWithServer(serverImpl, clientOptions, serverOptions)
+	return testClient, clientClose, teardown
+}
+
+// initClientServerSystemWithServer is the same as initClientServerSystemWith, but it returns the server as well.
+func initClientServerSystemWithServer(
+	serverImpl *testpb.TestServerImpl,
+	clientOptions []grpc.DialOption,
+	serverOptions []grpc.ServerOption,
+) (
+	server *grpc.Server,
+	testClient testpb.TestClient,
+	clientClose func(),
+	teardown func(),
 ) {
 	const serverDelay = 100 * time.Millisecond // allow server to lag behind a bit - to start in background, to process data etc
 
-	server := grpc.NewServer(serverOptions...)
-	testpb.RegisterTestServer(server, new(testpb.TestServerImpl))
+	server = grpc.NewServer(serverOptions...)
+	testpb.RegisterTestServer(server, serverImpl)
 
 	listener := bufconn.Listen(10 * 1024 * 1024 /* 10 MB buf */)
 	go func() {
@@ -66,5 +105,113 @@ func initClientServerSystem(
 		_ = listener.Close()
 	}
 
-	return testClient, clientClose, teardown
+	return server, testClient, clientClose, teardown
+}
+
+// runConcurrentStreams runs bidi streams in parallel, each one sends and receives messages concurrently
+// (request wire length is 8 bytes, response one is 16 bytes).
+func runConcurrentStreams(ctx context.Context, client testpb.TestClient, streams, msgs int) {
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		stream, err := client.Stream(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		wg.Add(2)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+
+			for j := 0; j < msgs; j++ {
+				Expect(stream.Send(&testpb.Message{Payload: "x"})).To(Succeed())
+			}
+			Expect(stream.CloseSend()).To(Succeed())
+		}()
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+
+			for j := 0; j < msgs; j++ {
+				_, err := stream.Recv()
+				Expect(err).NotTo(HaveOccurred())
+			}
+			_, err := stream.Recv()
+			Expect(errors.Is(err, io.EOF)).To(BeTrue())
+		}()
+	}
+	wg.Wait()
+}
+
+// newTypicalHandler returns a typical set of call instruments.
+func newTypicalHandler() stats.Handler {
+	reg := openmetrics.NewConsistentRegistry(mockTime)
+	labels := []string{"method", "side", "status"}
+	return Instrument(
+		InstrumentCallCount(reg.Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: labels,
+		})),
+		InstrumentCallDuration(reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_call_duration",
+			Unit:   "seconds",
+			Labels: labels,
+		}, []float64{.001, .01, .1, 1})),
+		InstrumentCallBytesReceived(reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_call_recv",
+			Unit:   "bytes",
+			Labels: labels,
+		}, []float64{100, 1000, 10000})),
+		InstrumentMessageBytesSent(reg.Histogram(openmetrics.Desc{
+			Name:   "grpc_message_sent",
+			Unit:   "bytes",
+			Labels: []string{"method", "side"},
+		}, []float64{100, 1000, 10000})),
+		InstrumentInFlightCalls(reg.Gauge(openmetrics.Desc{
+			Name:   "grpc_in_flight_calls",
+			Labels: []string{"method", "side"},
+		})),
+	)
+}
+
+// mockCall holds server-side stats events of a call, which can be replayed to stats handlers without grpc.
+type mockCall struct {
+	info       stats.RPCTagInfo
+	begin      stats.Begin
+	end        stats.End
+	inHeader   stats.InHeader
+	inPayload  stats.InPayload
+	outHeader  stats.OutHeader
+	outPayload stats.OutPayload
+	outTrailer stats.OutTrailer
+}
+
+// newMockCall returns events of a unary call or of a bidi streaming one, for streamMethod.
+func newMockCall(method string) *mockCall {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4567}
+	now := mockTime()
+	streaming := method == streamMethod
+	return &mockCall{
+		info:       stats.RPCTagInfo{FullMethodName: method},
+		begin:      stats.Begin{BeginTime: now, IsClientStream: streaming, IsServerStream: streaming},
+		end:        stats.End{BeginTime: now, EndTime: now.Add(time.Millisecond)},
+		inHeader:   stats.InHeader{FullMethod: method, RemoteAddr: addr, LocalAddr: addr, Header: metadata.MD{}, WireLength: 64},
+		inPayload:  stats.InPayload{Length: 100, WireLength: 105},
+		outHeader:  stats.OutHeader{Header: metadata.MD{}},
+		outPayload: stats.OutPayload{Length: 100, WireLength: 105},
+		outTrailer: stats.OutTrailer{Trailer: metadata.MD{}},
+	}
+}
+
+// run emits call events in grpc server order, with msgs request and response messages;
+// events are shared, so that only allocations of stats handler are reported.
+func (c *mockCall) run(h stats.Handler, msgs int) {
+	ctx := h.TagRPC(context.Background(), &c.info)
+	h.HandleRPC(ctx, &c.inHeader)
+	h.HandleRPC(ctx, &c.begin)
+	h.HandleRPC(ctx, &c.outHeader)
+	for i := 0; i < msgs; i++ {
+		h.HandleRPC(ctx, &c.inPayload)
+		h.HandleRPC(ctx, &c.outPayload)
+	}
+	h.HandleRPC(ctx, &c.outTrailer)
+	h.HandleRPC(ctx, &c.end)
 }
@@ -0,0 +1,167 @@
+package omgrpc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc/stats"
+)
+
+// Option configures Instrument* functions.
+type Option func(*options)
+
+// WithLabel sets custom call label extractor, overriding built-in one (if any).
+// Label name must be one of the metric family labels (case-insensitive) and it's applicable to call instruments only,
+// Instrument* functions panic otherwise.
+//
+// Extractors for in-flight instruments (like InstrumentInFlightCalls) are called
+// before call ends, so they must return the same value for the same call every time.
+func WithLabel(name string, extract LabelExtractor) Option {
+	return func(o *options) {
+		if o.callLabels == nil {
+			o.callLabels = make(map[string]LabelExtractor, 1)
+		}
+		o.callLabels[labelKey(name)] = extract
+		delete(o.callEndLabels, labelKey(name))
+	}
+}
+
+// WithConnLabel sets custom connection label extractor (for connection instruments like InstrumentActiveConns),
+// overriding built-in one (if any).
+// Label name must be one of the metric family labels (case-insensitive) and it's applicable to connection instruments only,
+// Instrument* functions panic otherwise.
+func WithConnLabel(name string, extract ConnLabelExtractor) Option {
+	return func(o *options) {
+		if o.connLabels == nil {
+			o.connLabels = make(map[string]ConnLabelExtractor, 1)
+		}
+		o.connLabels[labelKey(name)] = extract
+	}
+}
+
+// labelKey returns options key of the label, label names are case-insensitive (as built-in ones).
+func labelKey(name string) string {
+	return strings.ToLower(name)
+}
+
+type options struct {
+	callLabels    map[string]LabelExtractor
+	connLabels    map[string]ConnLabelExtractor
+	labelLimits   map[string]int
+	seriesLimit   int
+	knownMethods  *knownMethods
+	onLimit       func(metric, label string)
+	filter        *callFilter
+	builtinLabels map[string]LabelExtractor // built-in call label overrides by (lower-cased) label name
+	callEndLabels map[string]bool           // custom call labels, which are not known until call ends
+}
+
+// newCallOptions returns options of call instrument.
+func newCallOptions(desc *openmetrics.Desc, opts []Option) *options {
+	o := newOptions(desc, opts)
+	for name := range o.connLabels {
+		panic(fmt.Sprintf("omgrpc: metric %q tracks calls, connection label %q is not applicable", desc.Name, name))
+	}
+	return o
+}
+
+// newConnOptions returns options of connection instrument.
+func newConnOptions(desc *openmetrics.Desc, opts []Option) *options {
+	o := newOptions(desc, opts)
+	for name := range o.callLabels {
+		panic(fmt.Sprintf("omgrpc: metric %q tracks connections, call label %q is not applicable", desc.Name, name))
+	}
+	return o
+}
+
+func newOptions(desc *openmetrics.Desc, opts []Option) *options {
+	o := new(options)
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// options are keyed by lower-cased label names, re-key them by metric family labels:
+	if len(o.callLabels) != 0 {
+		callLabels := make(map[string]LabelExtractor, len(o.callLabels))
+		for name, extract := range o.callLabels {
+			callLabels[mustHaveLabel(desc, name)] = extract
+		}
+		o.callLabels = callLabels
+	}
+	if len(o.callEndLabels) != 0 {
+		callEndLabels := make(map[string]bool, len(o.callEndLabels))
+		for name := range o.callEndLabels {
+			callEndLabels[mustHaveLabel(desc, name)] = true
+		}
+		o.callEndLabels = callEndLabels
+	}
+	if len(o.connLabels) != 0 {
+		connLabels := make(map[string]ConnLabelExtractor, len(o.connLabels))
+		for name, extract := range o.connLabels {
+			connLabels[mustHaveLabel(desc, name)] = extract
+		}
+		o.connLabels = connLabels
+	}
+	if len(o.labelLimits) != 0 {
+		labelLimits := make(map[string]int, len(o.labelLimits))
+		for name, limit := range o.labelLimits {
+			labelLimits[mustHaveLabel(desc, name)] = limit
+		}
+		o.labelLimits = labelLimits
+	}
+	return o
+}
+
+func (o *options) callFilter() *callFilter {
+	if o.filter == nil {
+		o.filter = &callFilter{client: true, server: true}
+	}
+	return o.filter
+}
+
+// filterCalls applies call filter (if any) to call handler h.
+func (o *options) filterCalls(h stats.Handler) stats.Handler {
+	if o.filter == nil {
+		return h
+	}
+	return newFilteredHandler(o.filter, h)
+}
+
+// setBuiltinLabel overrides built-in call label extractor (custom ones set by WithLabel still take precedence).
+func (o *options) setBuiltinLabel(name string, extract LabelExtractor) {
+	if o.builtinLabels == nil {
+		o.builtinLabels = make(map[string]LabelExtractor, 1)
+	}
+	o.builtinLabels[name] = extract
+}
+
+// seriesCacheSize returns the max number of series, cached by instrument.
+func (o *options) seriesCacheSize() int {
+	if o.seriesLimit > 0 {
+		return o.seriesLimit
+	}
+	return defaultSeriesCacheSize
+}
+
+func (o *options) onLimitFunc(metric, label string) func() {
+	if o.onLimit == nil {
+		return nil
+	}
+	return func() { o.onLimit(metric, label) }
+}
+
+// mustHaveLabel returns metric family label, matching the name (case-insensitive).
+func mustHaveLabel(desc *openmetrics.Desc, name string) string {
+	return desc.Labels[mustLabelIndex(desc, name)]
+}
+
+// mustLabelIndex returns index of the label (case-insensitive) in metric family labels.
+func mustLabelIndex(desc *openmetrics.Desc, name string) int {
+	for i, l := range desc.Labels {
+		if strings.EqualFold(l, name) {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("omgrpc: metric %q has no label %q", desc.Name, name))
+}
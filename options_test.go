@@ -0,0 +1,103 @@
+package omgrpc_test
+
+import (
+	"context"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("Option", func() {
+	var (
+		ctx = context.Background()
+
+		callCount   openmetrics.CounterFamily
+		activeConns openmetrics.GaugeFamily
+		client      testpb.TestClient
+		clientClose func()
+		teardown    func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		callCount = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"method", "tenant"},
+		})
+		activeConns = reg.Gauge(openmetrics.Desc{
+			Name:   "grpc_active_conns",
+			Labels: []string{"side", "tenant"},
+		})
+
+		subject := Instrument(
+			InstrumentCallCount(callCount,
+				WithLabel("method", func(call *CallStats) string { return "overridden" }),
+				WithLabel("tenant", func(call *CallStats) string { return "acme" }),
+			),
+			InstrumentActiveConns(activeConns,
+				WithConnLabel("tenant", func(conn *ConnStats) string { return "acme" }),
+			),
+		)
+		client, clientClose, teardown = initClientServerSystem(
+			[]grpc.DialOption{
+				grpc.WithStatsHandler(subject),
+			},
+			[]grpc.ServerOption{
+				grpc.StatsHandler(subject),
+			},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("populates custom labels", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(activeConns.With("client", "acme").Value()).To(Equal(1.0))
+		Expect(activeConns.With("server", "acme").Value()).To(Equal(1.0))
+
+		clientClose()
+		Expect(callCount.NumMetrics()).To(Equal(1))
+		Expect(callCount.With("overridden", "acme").Total()).To(Equal(2.0))
+		Expect(activeConns.With("client", "acme").Value()).To(Equal(0.0))
+		Expect(activeConns.With("server", "acme").Value()).To(Equal(0.0))
+	})
+
+	It("validates label names", func() {
+		Expect(func() {
+			InstrumentCallCount(callCount, WithLabel("region", func(*CallStats) string { return "" }))
+		}).To(PanicWith(`omgrpc: metric "grpc_calls" has no label "region"`))
+	})
+
+	It("validates label kinds", func() {
+		Expect(func() {
+			InstrumentCallCount(callCount, WithConnLabel("tenant", func(*ConnStats) string { return "" }))
+		}).To(PanicWith(`omgrpc: metric "grpc_calls" tracks calls, connection label "tenant" is not applicable`))
+		Expect(func() {
+			InstrumentActiveConns(activeConns, WithLabel("tenant", func(*CallStats) string { return "" }))
+		}).To(PanicWith(`omgrpc: metric "grpc_active_conns" tracks connections, call label "tenant" is not applicable`))
+	})
+
+	It("matches label names case-insensitively", func() {
+		calls := openmetrics.NewConsistentRegistry(mockTime).Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"method", "Tenant"},
+		})
+		handler := InstrumentCallCount(calls,
+			WithLabel("tenant", func(*CallStats) string { return "acme" }),
+			WithLabelLimit("TENANT", 1),
+		)
+		newMockCall(unaryMethod).run(handler, 1)
+
+		Expect(calls.NumMetrics()).To(Equal(1))
+		Expect(calls.With(unaryMethod, "acme").Total()).To(Equal(1.0))
+	})
+})
@@ -0,0 +1,231 @@
+package omgrpc
+
+import (
+	"hash/maphash"
+	"sync"
+
+	"github.com/bsm/openmetrics"
+)
+
+// maxCachedLabels is the max number of metric family labels, which are resolved without allocations,
+// label values of families with more labels are allocated on every observation, but are still cached.
+const maxCachedLabels = 8
+
+// defaultSeriesCacheSize is the max number of cached series per instrument, when series are not limited (see WithSeriesLimit).
+const defaultSeriesCacheSize = 1000
+
+// labelValues holds label values of a series, they are kept on stack for up to maxCachedLabels labels.
+type labelValues struct {
+	buf     [maxCachedLabels]string
+	n       int
+	heap    []string       // used instead of buf for metric families with more labels
+	limiter *seriesLimiter // nil if series are not limited
+}
+
+// Set sets label value by index; it must be done before series is resolved, so that series limit applies to it.
+func (v *labelValues) Set(i int, value string) {
+	if v.heap != nil {
+		v.heap[i] = value
+	} else {
+		v.buf[i] = value
+	}
+}
+
+// Slice returns label values as a slice, it refers to the stack buffer, so it must not be retained.
+func (v *labelValues) Slice() []string {
+	if v.heap != nil {
+		return v.heap
+	}
+	return v.buf[:v.n]
+}
+
+// ----------------------------------------------------------------------------
+
+// seriesCache caches metric family series by label values, so known series are resolved
+// without allocating label values and without hashing them into the family again.
+//
+// Reads are lock-free, cache is bounded, series over its size are resolved by the family every time.
+type seriesCache struct {
+	entries sync.Map     // map[uint64]*seriesEntry, by label values hash
+	seed    maphash.Seed // label values hash seed
+	size    int          // max number of cached series
+	n       int          // number of cached series, guarded by mu
+	mu      sync.Mutex
+}
+
+type seriesEntry struct {
+	values []string
+	series interface{}
+	next   *seriesEntry // entry with the same hash, if any
+}
+
+func newSeriesCache(size int) *seriesCache {
+	return &seriesCache{seed: maphash.MakeSeed(), size: size}
+}
+
+// Get returns cached series for label values (and their hash) or nil.
+func (c *seriesCache) Get(hash uint64, values []string) interface{} {
+	head, _ := c.entries.Load(hash)
+	for e, _ := head.(*seriesEntry); e != nil; e = e.next {
+		if equalLabelValues(e.values, values) {
+			return e.series
+		}
+	}
+	return nil
+}
+
+// Put caches series for label values (and their hash), unless cache is full;
+// values must not be modified afterwards.
+func (c *seriesCache) Put(hash uint64, values []string, series interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.n >= c.size || c.Get(hash, values) != nil {
+		return // full or cached concurrently
+	}
+
+	head, _ := c.entries.Load(hash)
+	next, _ := head.(*seriesEntry)
+	c.entries.Store(hash, &seriesEntry{values: values, series: series, next: next})
+	c.n++
+}
+
+// resolve returns series for label values, known ones are returned from cache without allocations.
+// Series over the series limit are not cached, so that limit is reported every time.
+func (c *seriesCache) resolve(values *labelValues, fam seriesFamily) interface{} {
+	hash := c.hash(values.Slice())
+	if series := c.Get(hash, values.Slice()); series != nil {
+		return series
+	}
+
+	// values may be on stack, and limiter overwrites them, so they are copied before:
+	labels := append([]string(nil), values.Slice()...)
+	if values.limiter != nil && len(labels) != 0 && !values.limiter.Allow(labels) {
+		return fam.with(values.limiter.overflow(labels))
+	}
+
+	series := fam.with(labels)
+	c.Put(hash, labels, series)
+	return series
+}
+
+// hash returns hash of label values.
+func (c *seriesCache) hash(values []string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	for _, v := range values {
+		_, _ = h.WriteString(v)
+		_ = h.WriteByte(0xff) // separator, never appears in valid UTF-8 strings
+	}
+	return h.Sum64()
+}
+
+func equalLabelValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------------
+
+// seriesFamily resolves new metric family series by label values.
+type seriesFamily interface {
+	with(labels []string) interface{}
+}
+
+// observer is implemented by series of histogram and summary metric families.
+type observer interface {
+	Observe(float64)
+}
+
+// observerSeries is implemented by histogram and summary series.
+type observerSeries interface {
+	Observer(values labelValues) observer
+}
+
+// counterSeries resolves counter family series by label values.
+type counterSeries struct {
+	family openmetrics.CounterFamily
+	cache  *seriesCache
+}
+
+func newCounterSeries(m openmetrics.CounterFamily, o *options) *counterSeries {
+	return &counterSeries{family: m, cache: newSeriesCache(o.seriesCacheSize())}
+}
+
+// Get returns series for label values.
+func (s *counterSeries) Get(values labelValues) openmetrics.Counter {
+	return s.cache.resolve(&values, s).(openmetrics.Counter)
+}
+
+func (s *counterSeries) with(labels []string) interface{} {
+	return s.family.With(labels...)
+}
+
+// gaugeSeries resolves gauge family series by label values.
+type gaugeSeries struct {
+	family openmetrics.GaugeFamily
+	cache  *seriesCache
+}
+
+func newGaugeSeries(m openmetrics.GaugeFamily, o *options) *gaugeSeries {
+	return &gaugeSeries{family: m, cache: newSeriesCache(o.seriesCacheSize())}
+}
+
+// Get returns series for label values.
+func (s *gaugeSeries) Get(values labelValues) openmetrics.Gauge {
+	return s.cache.resolve(&values, s).(openmetrics.Gauge)
+}
+
+func (s *gaugeSeries) with(labels []string) interface{} {
+	return s.family.With(labels...)
+}
+
+// histogramSeries resolves histogram family series by label values.
+type histogramSeries struct {
+	family openmetrics.HistogramFamily
+	cache  *seriesCache
+}
+
+func newHistogramSeries(m openmetrics.HistogramFamily, o *options) *histogramSeries {
+	return &histogramSeries{family: m, cache: newSeriesCache(o.seriesCacheSize())}
+}
+
+// Get returns series for label values.
+func (s *histogramSeries) Get(values labelValues) openmetrics.Histogram {
+	return s.cache.resolve(&values, s).(openmetrics.Histogram)
+}
+
+// Observer returns series for label values.
+func (s *histogramSeries) Observer(values labelValues) observer {
+	return s.Get(values)
+}
+
+func (s *histogramSeries) with(labels []string) interface{} {
+	return s.family.With(labels...)
+}
+
+// summarySeries resolves summary family series by label values.
+type summarySeries struct {
+	family openmetrics.SummaryFamily
+	cache  *seriesCache
+}
+
+func newSummarySeries(m openmetrics.SummaryFamily, o *options) *summarySeries {
+	return &summarySeries{family: m, cache: newSeriesCache(o.seriesCacheSize())}
+}
+
+// Observer returns series for label values.
+func (s *summarySeries) Observer(values labelValues) observer {
+	return s.cache.resolve(&values, s).(openmetrics.Summary)
+}
+
+func (s *summarySeries) with(labels []string) interface{} {
+	return s.family.With(labels...)
+}
@@ -0,0 +1,88 @@
+package omgrpc_test
+
+import (
+	"testing"
+
+	"github.com/bsm/openmetrics"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("series cache", func() {
+	It("resolves known series without allocations", func() {
+		handler := newTypicalHandler()
+		call := newMockCall(streamMethod)
+		call.run(handler, 1) // resolve series
+
+		allocs := testing.AllocsPerRun(100, func() {
+			call.run(handler, 10)
+		})
+		Expect(allocs).To(Equal(1.0)) // call context
+	})
+
+	It("resolves series by label values", func() {
+		calls := openmetrics.NewConsistentRegistry(mockTime).Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"method"},
+		})
+		handler := InstrumentCallCount(calls)
+
+		unary, stream := newMockCall(unaryMethod), newMockCall(streamMethod)
+		for i := 0; i < 3; i++ {
+			unary.run(handler, 1)
+			stream.run(handler, 1)
+		}
+		unary.run(handler, 1)
+
+		Expect(calls.NumMetrics()).To(Equal(2))
+		Expect(calls.With(unaryMethod).Total()).To(Equal(4.0))
+		Expect(calls.With(streamMethod).Total()).To(Equal(3.0))
+	})
+
+	It("resolves series over the series limit", func() {
+		calls := openmetrics.NewConsistentRegistry(mockTime).Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: []string{"method"},
+		})
+		var limitsHit int
+		handler := InstrumentCallCount(calls, WithSeriesLimit(1), WithOnLimit(func(_, _ string) { limitsHit++ }))
+
+		unary, stream := newMockCall(unaryMethod), newMockCall(streamMethod)
+		for i := 0; i < 3; i++ {
+			unary.run(handler, 1)
+			stream.run(handler, 1)
+		}
+
+		Expect(calls.NumMetrics()).To(Equal(2))
+		Expect(calls.With(unaryMethod).Total()).To(Equal(3.0))
+		Expect(calls.With("other").Total()).To(Equal(3.0))
+		Expect(limitsHit).To(Equal(3))
+	})
+	It("resolves series of families with more labels", func() {
+		labels := []string{"method", "service", "method_name", "type", "side", "fail_fast", "status", "code", "status_class"}
+		calls := openmetrics.NewConsistentRegistry(mockTime).Counter(openmetrics.Desc{
+			Name:   "grpc_calls",
+			Labels: labels,
+		})
+		var limitsHit int
+		handler := InstrumentCallCount(calls, WithSeriesLimit(1), WithOnLimit(func(_, _ string) { limitsHit++ }))
+
+		unary, stream := newMockCall(unaryMethod), newMockCall(streamMethod)
+		for i := 0; i < 3; i++ {
+			unary.run(handler, 1)
+			stream.run(handler, 1)
+		}
+
+		other := make([]string, len(labels))
+		for i := range other {
+			other[i] = "other"
+		}
+		Expect(calls.NumMetrics()).To(Equal(2))
+		Expect(calls.With(unaryMethod, "com.blacksquaremedia.omgrpc.internal.testpb.Test", "Unary", "unary", "server", "false", "OK", "OK", StatusClassOK).Total()).To(Equal(3.0))
+		Expect(calls.With(other...).Total()).To(Equal(3.0))
+		Expect(limitsHit).To(Equal(3))
+	})
+})
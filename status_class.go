@@ -0,0 +1,78 @@
+package omgrpc
+
+import (
+	"google.golang.org/grpc/codes"
+)
+
+// Status classes, populated for "status_class" label (see WithStatusClasses to customize).
+const (
+	StatusClassOK          = "ok"
+	StatusClassClientError = "client_error"
+	StatusClassServerError = "server_error"
+	StatusClassTimeout     = "timeout"
+)
+
+// defaultStatusClasses holds default code to status class mapping.
+var defaultStatusClasses = statusClasses{
+	codes.OK:                 StatusClassOK,
+	codes.Canceled:           StatusClassTimeout,
+	codes.Unknown:            StatusClassServerError,
+	codes.InvalidArgument:    StatusClassClientError,
+	codes.DeadlineExceeded:   StatusClassTimeout,
+	codes.NotFound:           StatusClassClientError,
+	codes.AlreadyExists:      StatusClassClientError,
+	codes.PermissionDenied:   StatusClassClientError,
+	codes.ResourceExhausted:  StatusClassClientError,
+	codes.FailedPrecondition: StatusClassClientError,
+	codes.Aborted:            StatusClassClientError,
+	codes.OutOfRange:         StatusClassClientError,
+	codes.Unimplemented:      StatusClassServerError,
+	codes.Internal:           StatusClassServerError,
+	codes.Unavailable:        StatusClassServerError,
+	codes.DataLoss:           StatusClassServerError,
+	codes.Unauthenticated:    StatusClassClientError,
+}
+
+// StatusClass returns default status class for the code:
+//
+//   - "ok" - OK
+//   - "timeout" - Canceled, DeadlineExceeded
+//   - "client_error" - InvalidArgument, NotFound, AlreadyExists, PermissionDenied, ResourceExhausted,
+//     FailedPrecondition, Aborted, OutOfRange, Unauthenticated
+//   - "server_error" - Unknown, Unimplemented, Internal, Unavailable, DataLoss and any other code
+func StatusClass(code codes.Code) string {
+	return defaultStatusClasses.Get(code)
+}
+
+// WithStatusClasses overrides the default code to status class mapping (see StatusClass) for "status_class" label.
+// Codes, that are not in classes, are mapped by default.
+func WithStatusClasses(classes map[codes.Code]string) Option {
+	custom := defaultStatusClasses
+	for code, class := range classes {
+		if int(code) < len(custom) {
+			custom[code] = class
+		}
+	}
+
+	return func(o *options) {
+		o.setBuiltinLabel("status_class", custom.extractor())
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// statusClasses maps codes (as indexes) to status classes.
+type statusClasses [codes.Unauthenticated + 1]string
+
+func (c *statusClasses) Get(code codes.Code) string {
+	if int(code) < len(c) {
+		return c[code]
+	}
+	return StatusClassServerError
+}
+
+func (c *statusClasses) extractor() LabelExtractor {
+	return func(call *CallStats) string {
+		return c.Get(call.Code())
+	}
+}
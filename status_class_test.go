@@ -0,0 +1,76 @@
+package omgrpc_test
+
+import (
+	"context"
+
+	"github.com/bsm/omgrpc/internal/testpb"
+	"github.com/bsm/openmetrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	. "github.com/bsm/omgrpc"
+
+	. "github.com/bsm/ginkgo"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("StatusClass", func() {
+	It("classifies codes", func() {
+		Expect(StatusClass(codes.OK)).To(Equal("ok"))
+		Expect(StatusClass(codes.NotFound)).To(Equal("client_error"))
+		Expect(StatusClass(codes.Unavailable)).To(Equal("server_error"))
+		Expect(StatusClass(codes.DeadlineExceeded)).To(Equal("timeout"))
+		Expect(StatusClass(codes.Code(100))).To(Equal("server_error"))
+	})
+})
+
+var _ = Describe("WithStatusClasses", func() {
+	var (
+		ctx = context.Background()
+
+		defaultCalls openmetrics.CounterFamily
+		customCalls  openmetrics.CounterFamily
+		client       testpb.TestClient
+		clientClose  func()
+		teardown     func()
+	)
+
+	BeforeEach(func() {
+		reg := openmetrics.NewConsistentRegistry(mockTime)
+		defaultCalls = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_default_calls",
+			Labels: []string{"status_class"},
+		})
+		customCalls = reg.Counter(openmetrics.Desc{
+			Name:   "grpc_custom_calls",
+			Labels: []string{"status_class"},
+		})
+
+		client, clientClose, teardown = initClientServerSystemWith(
+			&testpb.TestServerImpl{UnaryError: status.Error(codes.NotFound, "not found")},
+			nil,
+			[]grpc.ServerOption{
+				grpc.StatsHandler(Instrument(
+					InstrumentCallCount(defaultCalls),
+					InstrumentCallCount(customCalls, WithStatusClasses(map[codes.Code]string{codes.NotFound: "ok"})),
+				)),
+			},
+		)
+	})
+
+	AfterEach(func() {
+		teardown()
+	})
+
+	It("populates status classes", func() {
+		_, err := client.Unary(ctx, &testpb.Message{Payload: "1"})
+		Expect(status.Code(err)).To(Equal(codes.NotFound))
+		clientClose()
+
+		Expect(defaultCalls.NumMetrics()).To(Equal(1))
+		Expect(defaultCalls.With("client_error").Total()).To(Equal(1.0))
+		Expect(customCalls.NumMetrics()).To(Equal(1))
+		Expect(customCalls.With("ok").Total()).To(Equal(1.0))
+	})
+})
@@ -0,0 +1,105 @@
+package omgrpc
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// transportError is a kind of grpc client transport error, recognized by classifyTransportError.
+type transportError int8
+
+const (
+	transportErrorNone         transportError = iota // not a transport error or not recognized
+	transportErrorClientClose                        // client connection was closed (grpc.ErrClientConnClosing)
+	transportErrorClosing                            // connection was closed, whatever closed it
+	transportErrorGoAway                             // server sent GOAWAY
+	transportErrorTooManyPings                       // server sent GOAWAY, enforcing keepalive policy
+	transportErrorBroken                             // connection was broken: read error or keepalive timeout
+	transportErrorOther                              // other transport error
+)
+
+// grpc converts client transport errors into Unavailable statuses, losing their type, so they are recognized
+// by messages, which are internal to grpc and may change with any release; so messages are matched
+// only for grpc versions, they were verified with, and only grpc.ErrClientConnClosing is recognized otherwise.
+var verifiedGRPCVersions = []string{"1.40."}
+
+// transportMsgsVerified is set, when grpc transport error messages are verified for grpc version in use.
+var transportMsgsVerified = isVerifiedGRPCVersion(grpc.Version)
+
+func isVerifiedGRPCVersion(version string) bool {
+	for _, prefix := range verifiedGRPCVersions {
+		if strings.HasPrefix(version, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// messages of grpc client transport errors, as of grpc@1.40.0:
+const (
+	transportMsgClosing         = "transport is closing"                                // transport.ErrConnClosing, whatever closed the connection
+	transportMsgDraining        = "the connection is draining"                          // stream was not processed before GOAWAY
+	transportMsgClosingDueTo    = "closing transport due to: "                          // connection was closed after GOAWAY
+	transportMsgPriorGoAway     = ", received prior goaway: "                           // followed by GOAWAY code and debug data
+	transportMsgConnectionError = "connection error: desc = "                           // transport.ConnectionError, followed by quoted description
+	transportMsgReadError       = "error reading from server: "                         // connection was broken
+	transportMsgKeepalive       = "keepalive ping failed to receive ACK within timeout" // keepalive timeout
+	transportMsgGoAway          = "received goaway"                                     // GOAWAY violated protocol or was received without active streams
+)
+
+// GOAWAY code and debug data, that grpc servers send, enforcing keepalive policy.
+const goAwayTooManyPings = `ENHANCE_YOUR_CALM, debug data: "too_many_pings"`
+
+// classifyTransportError returns the kind of client call error, if it was produced by grpc client connection
+// or transport, when it was closed or lost, rather than received from server.
+func classifyTransportError(err error) transportError {
+	if err == nil {
+		return transportErrorNone
+	}
+	if errors.Is(err, grpc.ErrClientConnClosing) {
+		return transportErrorClientClose
+	}
+	if !transportMsgsVerified {
+		return transportErrorNone
+	}
+
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.Unavailable {
+		return transportErrorNone
+	}
+
+	msg := st.Message()
+	switch {
+	case msg == transportMsgClosing:
+		return transportErrorClosing
+	case msg == transportMsgDraining:
+		return transportErrorGoAway
+	case msg == transportMsgKeepalive:
+		return transportErrorBroken
+	case strings.HasPrefix(msg, transportMsgClosingDueTo):
+		// "closing transport due to: <error>, received prior goaway: code: <code>[, debug data: <data>]":
+		if i := strings.LastIndex(msg, transportMsgPriorGoAway); i != -1 {
+			if strings.HasSuffix(msg[i:], goAwayTooManyPings) {
+				return transportErrorTooManyPings
+			}
+			return transportErrorGoAway
+		}
+		return transportErrorOther
+	case strings.HasPrefix(msg, transportMsgConnectionError):
+		if desc, err := strconv.Unquote(msg[len(transportMsgConnectionError):]); err == nil &&
+			(strings.HasPrefix(desc, transportMsgReadError) || desc == transportMsgKeepalive) {
+			return transportErrorBroken
+		}
+		return transportErrorOther
+	case strings.HasPrefix(msg, transportMsgReadError):
+		return transportErrorBroken
+	case strings.HasPrefix(msg, transportMsgGoAway):
+		return transportErrorOther
+	}
+	return transportErrorNone
+}